@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	anomalyFutureMtime      = "future_mtime"
+	anomalyEpochMtime       = "epoch_mtime"
+	anomalyImplausibleMtime = "implausible_mtime"
+)
+
+const defaultMinPlausibleMtime = "1980-01-01"
+
+// anomalyChecker flags mtimes that point at clock problems, bad extractions
+// or timestomping. A nil checker disables the checks.
+type anomalyChecker struct {
+	scanStart time.Time
+	floor     time.Time
+	tolerance time.Duration
+}
+
+// parsePlausibleFloor accepts a plain date or a full RFC3339 timestamp
+func parsePlausibleFloor(value string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid -min-plausible-mtime %q (want YYYY-MM-DD or RFC3339)", value)
+	}
+	return t, nil
+}
+
+func newAnomalyChecker(scanStart time.Time, floor time.Time, tolerance time.Duration) *anomalyChecker {
+	return &anomalyChecker{
+		scanStart: scanStart,
+		floor:     floor,
+		tolerance: tolerance,
+	}
+}
+
+// Check returns the anomalies triggered by mtime, or nil
+func (ac *anomalyChecker) Check(mtime time.Time) []string {
+	if ac == nil {
+		return nil
+	}
+
+	var anomalies []string
+	switch {
+	// Small skew between hosts (e.g. files written over NFS) is expected
+	case mtime.After(ac.scanStart.Add(ac.tolerance)):
+		anomalies = append(anomalies, anomalyFutureMtime)
+	case mtime.Unix() == 0:
+		anomalies = append(anomalies, anomalyEpochMtime)
+	case mtime.Before(ac.floor):
+		anomalies = append(anomalies, anomalyImplausibleMtime)
+	}
+	return anomalies
+}
+
+// formatAnomalyCounts renders counts as "type=n" pairs in a stable order
+func formatAnomalyCounts(counts map[string]int64) string {
+	kinds := make([]string, 0, len(counts))
+	for kind := range counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	parts := make([]string, len(kinds))
+	for i, kind := range kinds {
+		parts[i] = fmt.Sprintf("%s=%d", kind, counts[kind])
+	}
+	return strings.Join(parts, " ")
+}
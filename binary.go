@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const defaultBinaryImportLimit = 32
+
+// BinaryInfo is the executable metadata extracted by -inspect-binaries
+type BinaryInfo struct {
+	Format        string   `json:"format"`
+	Architectures []string `json:"architectures,omitempty"`
+	Bits          int      `json:"bits,omitempty"`
+	Linkage       string   `json:"linkage,omitempty"`
+	Imports       []string `json:"imports,omitempty"`
+	ImportCount   int      `json:"import_count,omitempty"`
+	Signed        *bool    `json:"signed,omitempty"` // nil when Error is set
+	Stripped      *bool    `json:"stripped,omitempty"`
+	Error         string   `json:"error,omitempty"` // header matched but the binary could not be parsed
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+// fileHeader keeps the first bytes of a file as it streams through the
+// hash pipeline, so format sniffing needs no extra read
+type fileHeader struct {
+	buf [16]byte
+	n   int
+}
+
+func (h *fileHeader) Write(p []byte) (int, error) {
+	if h.n < len(h.buf) {
+		h.n += copy(h.buf[h.n:], p)
+	}
+	return len(p), nil
+}
+
+func (h *fileHeader) Bytes() []byte {
+	return h.buf[:h.n]
+}
+
+// Fill reads the header directly when the file is not being hashed
+func (h *fileHeader) Fill(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	n, err := io.ReadFull(file, h.buf[:])
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	h.n = n
+	return nil
+}
+
+// binaryFormat identifies ELF, PE and Mach-O by magic number. "MZ" only
+// makes a candidate; inspectBinary confirms the PE signature.
+func binaryFormat(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("\x7fELF")):
+		return "elf"
+	case bytes.HasPrefix(head, []byte("MZ")):
+		return "pe"
+	case len(head) < 8:
+		return ""
+	}
+
+	switch binary.BigEndian.Uint32(head) {
+	case macho.Magic32, macho.Magic64:
+		return "macho"
+	case 0xcefaedfe, 0xcffaedfe: // little-endian Magic32/Magic64
+		return "macho"
+	case macho.MagicFat:
+		// Java class files share the magic; their version field is >= 45
+		// where a fat header has a small architecture count
+		if binary.BigEndian.Uint32(head[4:]) < 45 {
+			return "macho-fat"
+		}
+	}
+	return ""
+}
+
+// inspectBinary parses the executable at path. Malformed input degrades
+// to an entry with Error set; it never fails the file.
+func inspectBinary(path string, head []byte, importLimit int) (info *BinaryInfo) {
+	format := binaryFormat(head)
+	if format == "" || format == "pe" && !hasPESignature(path) {
+		return nil
+	}
+
+	info = &BinaryInfo{Format: format}
+	defer func() {
+		// The debug packages can panic on hostile input
+		if r := recover(); r != nil {
+			info = &BinaryInfo{Format: format, Error: fmt.Sprintf("unparseable: %v", r)}
+		}
+	}()
+
+	var err error
+	switch format {
+	case "elf":
+		err = inspectELF(path, info)
+	case "pe":
+		err = inspectPE(path, info)
+	case "macho":
+		err = inspectMachO(path, info)
+	case "macho-fat":
+		err = inspectFatMachO(path, info)
+	}
+	if err != nil {
+		return &BinaryInfo{Format: format, Error: "unparseable: " + err.Error()}
+	}
+
+	info.ImportCount = len(info.Imports)
+	if importLimit >= 0 && len(info.Imports) > importLimit {
+		info.Imports = info.Imports[:importLimit]
+	}
+	return info
+}
+
+// hasPESignature checks for "PE\0\0" at the offset the DOS header's
+// e_lfanew points to, which plain files starting with "MZ" lack
+func hasPESignature(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	var lfanew [4]byte
+	if _, err := file.ReadAt(lfanew[:], 0x3c); err != nil {
+		return false
+	}
+	var sig [4]byte
+	if _, err := file.ReadAt(sig[:], int64(binary.LittleEndian.Uint32(lfanew[:]))); err != nil {
+		return false
+	}
+	return string(sig[:]) == "PE\x00\x00"
+}
+
+func inspectELF(path string, info *BinaryInfo) error {
+	f, err := elf.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info.Architectures = []string{strings.ToLower(strings.TrimPrefix(f.Machine.String(), "EM_"))}
+	info.Bits = 64
+	if f.Class == elf.ELFCLASS32 {
+		info.Bits = 32
+	}
+
+	if info.Imports, err = f.ImportedLibraries(); err != nil {
+		return err
+	}
+	// Static-pie binaries carry PT_DYNAMIC for self-relocation but need no
+	// loader and no libraries
+	info.Linkage = "static"
+	if len(info.Imports) > 0 {
+		info.Linkage = "dynamic"
+	}
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_INTERP {
+			info.Linkage = "dynamic"
+		}
+	}
+
+	// ELF has no standard code-signature section
+	info.Signed = boolPtr(false)
+	info.Stripped = boolPtr(f.Section(".symtab") == nil)
+	return nil
+}
+
+var peMachines = map[uint16]string{
+	pe.IMAGE_FILE_MACHINE_I386:  "386",
+	pe.IMAGE_FILE_MACHINE_AMD64: "amd64",
+	pe.IMAGE_FILE_MACHINE_ARM:   "arm",
+	pe.IMAGE_FILE_MACHINE_ARMNT: "arm",
+	pe.IMAGE_FILE_MACHINE_ARM64: "arm64",
+}
+
+func inspectPE(path string, info *BinaryInfo) error {
+	f, err := pe.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	arch, ok := peMachines[f.Machine]
+	if !ok {
+		arch = fmt.Sprintf("0x%x", f.Machine)
+	}
+	info.Architectures = []string{arch}
+
+	var dirs []pe.DataDirectory
+	switch oh := f.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		info.Bits = 32
+		dirs = oh.DataDirectory[:oh.NumberOfRvaAndSizes]
+	case *pe.OptionalHeader64:
+		info.Bits = 64
+		dirs = oh.DataDirectory[:oh.NumberOfRvaAndSizes]
+	}
+
+	if info.Imports, err = f.ImportedLibraries(); err != nil {
+		return err
+	}
+	info.Linkage = "static"
+	if len(info.Imports) > 0 {
+		info.Linkage = "dynamic"
+	}
+
+	// An Authenticode signature lives in the certificate table
+	signed := false
+	if len(dirs) > pe.IMAGE_DIRECTORY_ENTRY_SECURITY {
+		security := dirs[pe.IMAGE_DIRECTORY_ENTRY_SECURITY]
+		signed = security.VirtualAddress != 0 && security.Size != 0
+	}
+	info.Signed = boolPtr(signed)
+
+	// MSVC records its PDB in the debug directory; MinGW and Go keep a COFF
+	// symbol table instead. Stripped means neither is left.
+	debug := len(dirs) > pe.IMAGE_DIRECTORY_ENTRY_DEBUG && dirs[pe.IMAGE_DIRECTORY_ENTRY_DEBUG].Size != 0
+	info.Stripped = boolPtr(!debug && f.NumberOfSymbols == 0)
+	return nil
+}
+
+const machoLoadCodeSignature = 0x1d
+
+func machoArch(f *macho.File) string {
+	return strings.ToLower(strings.TrimPrefix(f.Cpu.String(), "Cpu"))
+}
+
+func machoSigned(f *macho.File) bool {
+	for _, load := range f.Loads {
+		raw := load.Raw()
+		if len(raw) >= 4 && f.ByteOrder.Uint32(raw) == machoLoadCodeSignature {
+			return true
+		}
+	}
+	return false
+}
+
+func describeMachO(f *macho.File, info *BinaryInfo) error {
+	imports, err := f.ImportedLibraries()
+	if err != nil {
+		return err
+	}
+	info.Imports = imports
+	info.Linkage = "static"
+	if len(imports) > 0 {
+		info.Linkage = "dynamic"
+	}
+	info.Signed = boolPtr(machoSigned(f))
+	info.Stripped = boolPtr(f.Symtab == nil || len(f.Symtab.Syms) == 0)
+	return nil
+}
+
+func inspectMachO(path string, info *BinaryInfo) error {
+	f, err := macho.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info.Architectures = []string{machoArch(f)}
+	info.Bits = 32
+	if f.Magic == macho.Magic64 {
+		info.Bits = 64
+	}
+	return describeMachO(f, info)
+}
+
+// inspectFatMachO reports every slice's architecture; the remaining
+// fields describe the first slice, except that signed and stripped must
+// hold for all of them
+func inspectFatMachO(path string, info *BinaryInfo) error {
+	fat, err := macho.OpenFat(path)
+	if err != nil {
+		return err
+	}
+	defer fat.Close()
+
+	if len(fat.Arches) == 0 {
+		return fmt.Errorf("fat binary has no architectures")
+	}
+	for i, arch := range fat.Arches {
+		info.Architectures = append(info.Architectures, machoArch(arch.File))
+		if i == 0 {
+			if arch.Magic == macho.Magic64 {
+				info.Bits = 64
+			} else {
+				info.Bits = 32
+			}
+			if err := describeMachO(arch.File, info); err != nil {
+				return err
+			}
+			continue
+		}
+		*info.Signed = *info.Signed && machoSigned(arch.File)
+		*info.Stripped = *info.Stripped && (arch.Symtab == nil || len(arch.Symtab.Syms) == 0)
+	}
+	return nil
+}
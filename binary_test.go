@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// elfSpec describes a minimal x86-64 ELF: interp adds PT_INTERP, dynamic
+// adds PT_DYNAMIC and a .dynamic section listing needed
+type elfSpec struct {
+	typ     elf.Type
+	interp  string
+	dynamic bool
+	needed  []string
+}
+
+func buildELF(t *testing.T, spec elfSpec) []byte {
+	t.Helper()
+	const (
+		ehdrSize = 64
+		phdrSize = 56
+		shdrSize = 64
+	)
+	var progs []elf.Prog64
+	var sections []elf.Section64
+	shstrtab := []byte{0}
+	section := func(name string, sh elf.Section64) {
+		sh.Name = uint32(len(shstrtab))
+		shstrtab = append(append(shstrtab, name...), 0)
+		sections = append(sections, sh)
+	}
+	sections = append(sections, elf.Section64{})
+
+	nprogs := 1
+	if spec.interp != "" {
+		nprogs++
+	}
+	if spec.dynamic {
+		nprogs++
+	}
+	dataStart := uint64(ehdrSize + nprogs*phdrSize)
+	var data bytes.Buffer
+	offset := func() uint64 { return dataStart + uint64(data.Len()) }
+
+	if spec.interp != "" {
+		off := offset()
+		data.WriteString(spec.interp + "\x00")
+		progs = append(progs, elf.Prog64{Type: uint32(elf.PT_INTERP), Flags: uint32(elf.PF_R),
+			Off: off, Vaddr: off, Paddr: off, Filesz: uint64(len(spec.interp) + 1), Memsz: uint64(len(spec.interp) + 1), Align: 1})
+	}
+	if spec.dynamic {
+		dynstr := []byte{0}
+		var dyns []elf.Dyn64
+		for _, lib := range spec.needed {
+			dyns = append(dyns, elf.Dyn64{Tag: int64(elf.DT_NEEDED), Val: uint64(len(dynstr))})
+			dynstr = append(append(dynstr, lib...), 0)
+		}
+		dyns = append(dyns, elf.Dyn64{Tag: int64(elf.DT_NULL)})
+
+		strOff := offset()
+		data.Write(dynstr)
+		section(".dynstr", elf.Section64{Type: uint32(elf.SHT_STRTAB), Flags: uint64(elf.SHF_ALLOC),
+			Addr: strOff, Off: strOff, Size: uint64(len(dynstr)), Addralign: 1})
+
+		for data.Len()%8 != 0 {
+			data.WriteByte(0)
+		}
+		dynOff := offset()
+		if err := binary.Write(&data, binary.LittleEndian, dyns); err != nil {
+			t.Fatal(err)
+		}
+		dynSize := offset() - dynOff
+		section(".dynamic", elf.Section64{Type: uint32(elf.SHT_DYNAMIC), Flags: uint64(elf.SHF_ALLOC | elf.SHF_WRITE),
+			Addr: dynOff, Off: dynOff, Size: dynSize, Link: 1, Addralign: 8, Entsize: 16})
+		progs = append(progs, elf.Prog64{Type: uint32(elf.PT_DYNAMIC), Flags: uint32(elf.PF_R | elf.PF_W),
+			Off: dynOff, Vaddr: dynOff, Paddr: dynOff, Filesz: dynSize, Memsz: dynSize, Align: 8})
+	}
+
+	shstrOff := offset()
+	section(".shstrtab", elf.Section64{Type: uint32(elf.SHT_STRTAB), Off: shstrOff, Addralign: 1})
+	sections[len(sections)-1].Size = uint64(len(shstrtab))
+	data.Write(shstrtab)
+	for data.Len()%8 != 0 {
+		data.WriteByte(0)
+	}
+	shoff := offset()
+	size := shoff + uint64(len(sections)*shdrSize)
+	progs = append([]elf.Prog64{{Type: uint32(elf.PT_LOAD), Flags: uint32(elf.PF_R | elf.PF_X),
+		Filesz: size, Memsz: size, Align: 0x1000}}, progs...)
+
+	hdr := elf.Header64{
+		Type:      uint16(spec.typ),
+		Machine:   uint16(elf.EM_X86_64),
+		Version:   uint32(elf.EV_CURRENT),
+		Phoff:     ehdrSize,
+		Shoff:     shoff,
+		Ehsize:    ehdrSize,
+		Phentsize: phdrSize,
+		Phnum:     uint16(len(progs)),
+		Shentsize: shdrSize,
+		Shnum:     uint16(len(sections)),
+		Shstrndx:  uint16(len(sections) - 1),
+	}
+	copy(hdr.Ident[:], elf.ELFMAG)
+	hdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	hdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	hdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+	var out bytes.Buffer
+	for _, v := range []interface{}{hdr, progs, data.Bytes(), sections} {
+		if err := binary.Write(&out, binary.LittleEndian, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return out.Bytes()
+}
+
+// inspectBytes writes data to a file and inspects it as the scan would
+func inspectBytes(t *testing.T, data []byte) *BinaryInfo {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "bin")
+	if err := os.WriteFile(path, data, 0755); err != nil {
+		t.Fatal(err)
+	}
+	var head fileHeader
+	if err := head.Fill(path); err != nil {
+		t.Fatal(err)
+	}
+	return inspectBinary(path, head.Bytes(), defaultBinaryImportLimit)
+}
+
+func TestInspectELFLinkage(t *testing.T) {
+	const loader = "/lib64/ld-linux-x86-64.so.2"
+	cases := []struct {
+		name    string
+		spec    elfSpec
+		linkage string
+		imports []string
+	}{
+		{"static", elfSpec{typ: elf.ET_EXEC}, "static", nil},
+		{"static-pie", elfSpec{typ: elf.ET_DYN, dynamic: true}, "static", nil},
+		{"dynamic", elfSpec{typ: elf.ET_DYN, interp: loader, dynamic: true, needed: []string{"libc.so.6"}}, "dynamic", []string{"libc.so.6"}},
+		{"shared-object", elfSpec{typ: elf.ET_DYN, dynamic: true, needed: []string{"libm.so.6", "libc.so.6"}}, "dynamic", []string{"libm.so.6", "libc.so.6"}},
+	}
+	for _, tc := range cases {
+		info := inspectBytes(t, buildELF(t, tc.spec))
+		if info == nil || info.Error != "" {
+			t.Fatalf("%s: inspectBinary = %+v", tc.name, info)
+		}
+		if info.Format != "elf" || info.Bits != 64 || !reflect.DeepEqual(info.Architectures, []string{"x86_64"}) {
+			t.Errorf("%s: format %q bits %d architectures %v", tc.name, info.Format, info.Bits, info.Architectures)
+		}
+		if info.Linkage != tc.linkage {
+			t.Errorf("%s: linkage = %q, want %q", tc.name, info.Linkage, tc.linkage)
+		}
+		if !reflect.DeepEqual(info.Imports, tc.imports) || info.ImportCount != len(tc.imports) {
+			t.Errorf("%s: imports = %v (%d), want %v", tc.name, info.Imports, info.ImportCount, tc.imports)
+		}
+		if info.Signed == nil || *info.Signed || info.Stripped == nil || !*info.Stripped {
+			t.Errorf("%s: signed %v stripped %v, want unsigned and stripped", tc.name, info.Signed, info.Stripped)
+		}
+	}
+}
+
+func TestInspectBinaryMalformed(t *testing.T) {
+	elfData := buildELF(t, elfSpec{typ: elf.ET_EXEC})
+	pe := make([]byte, 0x48)
+	copy(pe, "MZ")
+	binary.LittleEndian.PutUint32(pe[0x3c:], 0x40)
+	copy(pe[0x40:], "PE\x00\x00")
+
+	cases := []struct {
+		name   string
+		data   []byte
+		format string
+	}{
+		{"truncated-elf", elfData[:40], "elf"},
+		{"truncated-pe", pe, "pe"},
+	}
+	for _, tc := range cases {
+		info := inspectBytes(t, tc.data)
+		if info == nil || info.Format != tc.format || !strings.HasPrefix(info.Error, "unparseable") {
+			t.Fatalf("%s: inspectBinary = %+v, want an unparseable %s", tc.name, info, tc.format)
+		}
+		data, err := json.Marshal(info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(data, []byte(`"signed"`)) || bytes.Contains(data, []byte(`"stripped"`)) {
+			t.Errorf("%s: unparseable binary reports signed/stripped: %s", tc.name, data)
+		}
+	}
+}
+
+func TestInspectBinaryNeedsPESignature(t *testing.T) {
+	for _, data := range []string{
+		"MZ is also how this text file starts\n",
+		"MZ" + strings.Repeat(" ", 0x3a) + "\x00\x01\x00\x00" + strings.Repeat("x", 0x100),
+	} {
+		if info := inspectBytes(t, []byte(data)); info != nil {
+			t.Errorf("%q classified as %+v", data[:10], info)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	defaultChunkThreshold = 1 << 30
+	defaultChunkSize      = 64 << 20
+
+	// hashSchemeTree prefixes the chunk size, e.g. "sha256-tree-64MiB".
+	// Entries without a scheme are a plain sha256 of the whole file.
+	hashSchemeSHA256 = "sha256"
+	hashSchemeTree   = "sha256-tree-"
+
+	chunkReadBuffer = 1 << 20
+)
+
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"TiB", 1 << 40},
+	{"GiB", 1 << 30},
+	{"MiB", 1 << 20},
+	{"KiB", 1 << 10},
+}
+
+// formatByteSize renders n in the largest binary unit that divides it
+// exactly, so the result parses back to the same value
+func formatByteSize(n int64) string {
+	for _, unit := range byteUnits {
+		if n >= unit.size && n%unit.size == 0 {
+			return strconv.FormatInt(n/unit.size, 10) + unit.suffix
+		}
+	}
+	return strconv.FormatInt(n, 10) + "B"
+}
+
+func parseByteSize(value string) (int64, error) {
+	number, scale := value, int64(1)
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			number, scale = strings.TrimSuffix(value, unit.suffix), unit.size
+			break
+		}
+	}
+	if scale == 1 {
+		number = strings.TrimSuffix(value, "B")
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q (e.g. 65536, 512KiB, 64MiB, 1GiB)", value)
+	}
+	return n * scale, nil
+}
+
+// byteSizeFlag parses sizes such as 64MiB or 1GiB
+type byteSizeFlag int64
+
+func (bs *byteSizeFlag) String() string {
+	return formatByteSize(int64(*bs))
+}
+
+func (bs *byteSizeFlag) Set(value string) error {
+	n, err := parseByteSize(value)
+	if err != nil {
+		return err
+	}
+	*bs = byteSizeFlag(n)
+	return nil
+}
+
+func treeScheme(chunkSize int64) string {
+	return hashSchemeTree + formatByteSize(chunkSize)
+}
+
+// parseHashScheme returns the chunk size a scheme declares, 0 for plain sha256
+func parseHashScheme(scheme string) (int64, error) {
+	if scheme == "" || scheme == hashSchemeSHA256 {
+		return 0, nil
+	}
+	if !strings.HasPrefix(scheme, hashSchemeTree) {
+		return 0, fmt.Errorf("unknown hash scheme %q", scheme)
+	}
+	chunkSize, err := parseByteSize(strings.TrimPrefix(scheme, hashSchemeTree))
+	if err != nil {
+		return 0, fmt.Errorf("unknown hash scheme %q", scheme)
+	}
+	return chunkSize, nil
+}
+
+// chunkHasher splits files above threshold into chunks hashed in parallel.
+// Every reader holds one of the slots, which are sized to the worker count:
+// a worker always holds its own, and chunk helpers only borrow slots that
+// idle workers have left free, so concurrent reads never exceed -workers.
+type chunkHasher struct {
+	threshold int64
+	chunkSize int64
+	slots     chan struct{}
+
+	// Readers currently in a file and the most seen at once
+	readers     int64
+	peakReaders int64
+}
+
+func newChunkHasher(threshold, chunkSize int64, workers int) *chunkHasher {
+	if workers < 1 {
+		workers = 1
+	}
+	return &chunkHasher{
+		threshold: threshold,
+		chunkSize: chunkSize,
+		slots:     make(chan struct{}, workers),
+	}
+}
+
+func (ch *chunkHasher) startRead() {
+	n := atomic.AddInt64(&ch.readers, 1)
+	for {
+		peak := atomic.LoadInt64(&ch.peakReaders)
+		if n <= peak || atomic.CompareAndSwapInt64(&ch.peakReaders, peak, n) {
+			return
+		}
+	}
+}
+
+func (ch *chunkHasher) endRead() {
+	atomic.AddInt64(&ch.readers, -1)
+}
+
+// plainHash is a whole-file sha256 by the caller, who holds a slot
+func (ch *chunkHasher) plainHash(path string, head *fileHeader) (string, error) {
+	ch.startRead()
+	defer ch.endRead()
+	return calculateSHA256(path, head)
+}
+
+// Hash digests path, chunked when it is at least threshold bytes, and
+// returns the scheme it used ("" for plain sha256)
+func (ch *chunkHasher) Hash(path string, size int64, head *fileHeader) (string, string, error) {
+	if size < ch.threshold {
+		ch.slots <- struct{}{}
+		defer func() { <-ch.slots }()
+		hash, err := ch.plainHash(path, head)
+		return hash, "", err
+	}
+	hash, err := ch.HashScheme(path, ch.chunkSize, head)
+	return hash, treeScheme(ch.chunkSize), err
+}
+
+// HashScheme digests path with an explicit chunk size, 0 meaning plain sha256
+func (ch *chunkHasher) HashScheme(path string, chunkSize int64, head *fileHeader) (string, error) {
+	ch.slots <- struct{}{}
+	defer func() { <-ch.slots }()
+
+	if chunkSize == 0 {
+		return ch.plainHash(path, head)
+	}
+	return ch.treeHash(path, chunkSize, head)
+}
+
+// treeHash is the sha256 of the concatenated raw sha256s of each chunk.
+// The caller holds a slot; more are borrowed while chunks remain unclaimed.
+func (ch *chunkHasher) treeHash(path string, chunkSize int64, head *fileHeader) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	size := info.Size()
+	chunks := (size + chunkSize - 1) / chunkSize
+	digests := make([][sha256.Size]byte, chunks)
+
+	var next int64
+	claim := func() (int64, bool) {
+		i := atomic.AddInt64(&next, 1) - 1
+		return i, i < chunks
+	}
+
+	var (
+		failed   atomic.Bool
+		errMutex sync.Mutex
+		firstErr error
+	)
+	hashChunk := func(i int64, buf []byte) bool {
+		offset := i * chunkSize
+		length := min(chunkSize, size-offset)
+		var r io.Reader = io.NewSectionReader(file, offset, length)
+		if i == 0 && head != nil {
+			r = io.TeeReader(r, head)
+		}
+
+		hash := sha256.New()
+		ch.startRead()
+		n, err := io.CopyBuffer(hash, r, buf)
+		ch.endRead()
+		if err == nil && n != length {
+			err = fmt.Errorf("file shrank while hashing chunk %d", i)
+		}
+		if err != nil {
+			errMutex.Lock()
+			if firstErr == nil {
+				firstErr = err
+			}
+			errMutex.Unlock()
+			failed.Store(true)
+			return false
+		}
+		hash.Sum(digests[i][:0])
+		return true
+	}
+
+	var wg sync.WaitGroup
+	var helpers int64
+	helper := func() {
+		defer wg.Done()
+		defer atomic.AddInt64(&helpers, -1)
+		defer func() { <-ch.slots }()
+		buf := make([]byte, chunkReadBuffer)
+		for !failed.Load() {
+			i, ok := claim()
+			if !ok || !hashChunk(i, buf) {
+				return
+			}
+		}
+	}
+
+	buf := make([]byte, chunkReadBuffer)
+	for !failed.Load() {
+		i, ok := claim()
+		if !ok {
+			break
+		}
+		// Workers that went idle since the last chunk free up slots
+	recruit:
+		for atomic.LoadInt64(&helpers) < chunks-atomic.LoadInt64(&next) {
+			select {
+			case ch.slots <- struct{}{}:
+				atomic.AddInt64(&helpers, 1)
+				wg.Add(1)
+				go helper()
+			default:
+				break recruit
+			}
+		}
+		if !hashChunk(i, buf) {
+			break
+		}
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return "", firstErr
+	}
+
+	tree := sha256.New()
+	for i := range digests {
+		tree.Write(digests[i][:])
+	}
+	return fmt.Sprintf("%x", tree.Sum(nil)), nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// sparseFile creates a file of size bytes without writing its contents
+func sparseFile(tb testing.TB, dir, name string, size int64) string {
+	tb.Helper()
+	path := filepath.Join(dir, name)
+	file, err := os.Create(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer file.Close()
+	if err := file.Truncate(size); err != nil {
+		tb.Fatal(err)
+	}
+	return path
+}
+
+// referenceTreeHash computes the tree digest sequentially
+func referenceTreeHash(t *testing.T, path string, chunkSize int64) string {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	tree := sha256.New()
+	for {
+		chunk := sha256.New()
+		n, err := io.CopyN(chunk, file, chunkSize)
+		if n > 0 {
+			tree.Write(chunk.Sum(nil))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return fmt.Sprintf("%x", tree.Sum(nil))
+}
+
+func TestTreeHashMatchesReference(t *testing.T) {
+	dir := t.TempDir()
+	path := sparseFile(t, dir, "image.img", 10<<20+123)
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt([]byte("not all zeroes"), 5<<20)
+	file.Close()
+
+	ch := newChunkHasher(1<<20, 1<<20, 4)
+	hash, scheme, err := ch.Hash(path, 10<<20+123, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scheme != "sha256-tree-1MiB" {
+		t.Errorf("scheme = %q, want sha256-tree-1MiB", scheme)
+	}
+	if want := referenceTreeHash(t, path, 1<<20); hash != want {
+		t.Errorf("tree hash = %s, want %s", hash, want)
+	}
+}
+
+func TestVerifyManifestSchemes(t *testing.T) {
+	// verifyEntry reports on stdout
+	silenceStdout(t)
+
+	root := t.TempDir()
+	big := sparseFile(t, root, "disk.img", 2*defaultChunkSize+4096)
+	if err := os.WriteFile(filepath.Join(root, "notes.txt"), []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := newChunkHasher(defaultChunkThreshold, defaultChunkSize, 4)
+	treeHash, err := ch.HashScheme(big, defaultChunkSize, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := ManifestResult{Files: []FileInfo{
+		{Path: "disk.img", SHA256: treeHash, HashScheme: "sha256-tree-64MiB"},
+		{Path: "notes.txt", SHA256: fmt.Sprintf("%x", sha256.Sum256([]byte("hello\n")))},
+	}}
+	data, err := json.Marshal(&manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestPath := filepath.Join(t.TempDir(), "manifest.json")
+	if err := os.WriteFile(manifestPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := verifyManifest(root, manifestPath, 4, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.matched != 2 {
+		t.Fatalf("untouched tree: %+v, want 2 matched", *report)
+	}
+
+	// Flip a byte inside the middle chunk
+	file, err := os.OpenFile(big, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteAt([]byte{1}, defaultChunkSize+12345); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	report, err = verifyManifest(root, manifestPath, 4, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.OK() || report.mismatched != 1 || report.matched != 1 {
+		t.Fatalf("tampered chunk: %+v, want 1 mismatched and 1 matched", *report)
+	}
+}
+
+func TestChunkHasherRespectsSlots(t *testing.T) {
+	const slots = 3
+	dir := t.TempDir()
+	var paths []string
+	for i := 0; i < 6; i++ {
+		paths = append(paths, sparseFile(t, dir, fmt.Sprintf("big%d", i), 64<<20))
+	}
+	for i := 0; i < 6; i++ {
+		paths = append(paths, sparseFile(t, dir, fmt.Sprintf("small%d", i), 64<<10))
+	}
+
+	ch := newChunkHasher(1<<20, 4<<20, slots)
+	var wg sync.WaitGroup
+	for _, path := range paths {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if _, _, err := ch.Hash(path, info.Size(), nil); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if peak := ch.peakReaders; peak > slots {
+		t.Errorf("%d concurrent readers, slot count is %d", peak, slots)
+	}
+	if ch.readers != 0 || len(ch.slots) != 0 {
+		t.Errorf("%d readers and %d slots still held after all hashes returned", ch.readers, len(ch.slots))
+	}
+}
+
+// BenchmarkTreeHash hashes one sparse file with a growing slot pool; on
+// fast storage throughput should scale close to linearly with slots
+func BenchmarkTreeHash(b *testing.B) {
+	const size = 1 << 30
+	path := sparseFile(b, b.TempDir(), "sparse.img", size)
+	for _, slots := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("slots=%d", slots), func(b *testing.B) {
+			ch := newChunkHasher(0, defaultChunkSize, slots)
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				if _, err := ch.HashScheme(path, defaultChunkSize, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// fieldSet is a bitmask over the FileInfo fields, indexed in struct order
+type fieldSet uint64
+
+type fileField struct {
+	name      string
+	index     int
+	omitEmpty bool
+}
+
+// fileFields is derived from the FileInfo json tags so new fields become
+// selectable without touching this file
+var fileFields = func() []fileField {
+	t := reflect.TypeOf(FileInfo{})
+	var fields []fileField
+	for i := 0; i < t.NumField(); i++ {
+		name, opts, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		fields = append(fields, fileField{name: name, index: i, omitEmpty: strings.Contains(opts, "omitempty")})
+	}
+	return fields
+}()
+
+var allFileFields = func() fieldSet {
+	var fs fieldSet
+	for i := range fileFields {
+		fs |= 1 << i
+	}
+	return fs
+}()
+
+var (
+	fieldPath       = mustFileField("path")
+	fieldSHA256     = mustFileField("sha256")
+	fieldHashScheme = mustFileField("hash_scheme")
+	fieldTrustScore = mustFileField("trust_score")
+	fieldAgent      = mustFileField("agent")
+	fieldLayer      = mustFileField("layer")
+	fieldBinary     = mustFileField("binary")
+)
+
+func lookupFileField(name string) (fieldSet, bool) {
+	for i, f := range fileFields {
+		if f.name == name {
+			return 1 << i, true
+		}
+	}
+	return 0, false
+}
+
+func mustFileField(name string) fieldSet {
+	fs, ok := lookupFileField(name)
+	if !ok {
+		panic("unknown FileInfo field " + name)
+	}
+	return fs
+}
+
+func fileFieldNames() []string {
+	names := make([]string, len(fileFields))
+	for i, f := range fileFields {
+		names[i] = f.name
+	}
+	return names
+}
+
+// Has reports whether every field in other is selected
+func (fs fieldSet) Has(other fieldSet) bool {
+	return fs&other == other
+}
+
+// Names lists the selected fields in FileInfo order
+func (fs fieldSet) Names() []string {
+	var names []string
+	for i, f := range fileFields {
+		if fs&(1<<i) != 0 {
+			names = append(names, f.name)
+		}
+	}
+	return names
+}
+
+// fieldsFlag parses -fields; path is always included
+type fieldsFlag struct {
+	set fieldSet
+}
+
+func (ff *fieldsFlag) String() string {
+	if ff.set == 0 {
+		return ""
+	}
+	return strings.Join(ff.set.Names(), ",")
+}
+
+func (ff *fieldsFlag) Set(value string) error {
+	set := fieldPath
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		field, ok := lookupFileField(name)
+		if !ok {
+			return fmt.Errorf("unknown field %q (valid: %s)", name, strings.Join(fileFieldNames(), ", "))
+		}
+		set |= field
+	}
+	ff.set = set
+	return nil
+}
+
+// Fields returns the selection, defaulting to every field
+func (ff *fieldsFlag) Fields() fieldSet {
+	if ff.set == 0 {
+		return allFileFields
+	}
+	return ff.set
+}
+
+// encodeFileEntry appends the compact JSON of one entry to buf, restricted
+// to fields
+func encodeFileEntry(buf *bytes.Buffer, file *FileInfo, fields fieldSet) error {
+	if fields == 0 || fields == allFileFields {
+		encoded, err := json.Marshal(file)
+		if err != nil {
+			return fmt.Errorf("failed to encode %s: %w", file.Path, err)
+		}
+		buf.Write(encoded)
+		return nil
+	}
+
+	v := reflect.ValueOf(file).Elem()
+	buf.WriteByte('{')
+	first := true
+	for j, f := range fileFields {
+		if fields&(1<<j) == 0 {
+			continue
+		}
+		value := v.Field(f.index)
+		if f.omitEmpty && value.IsZero() {
+			continue
+		}
+		encoded, err := json.Marshal(value.Interface())
+		if err != nil {
+			return fmt.Errorf("failed to encode %s of %s: %w", f.name, file.Path, err)
+		}
+		if !first {
+			buf.WriteByte(',')
+		}
+		first = false
+		fmt.Fprintf(buf, "%q:", f.name)
+		buf.Write(encoded)
+	}
+	buf.WriteByte('}')
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func sampleManifest() *ManifestResult {
+	return &ManifestResult{
+		Files: []FileInfo{
+			{Path: "a/<b>.go", Size: 12, Mtime: "2024-01-01T00:00:00Z", SHA256: "abc", TrustScore: 0.7, Agent: "golang"},
+			{Path: "bin/tool", Size: 99, SHA256: "def", Anomalies: []string{"epoch_mtime"},
+				Binary: &BinaryInfo{Format: "elf", Imports: []string{"libc.so.6"}}},
+		},
+		FailedFiles:    []FailedFile{{Path: "x", Reason: "denied"}},
+		TotalFiles:     3,
+		ProcessedFiles: 2,
+		AnomalyCounts:  map[string]int64{"epoch_mtime": 1},
+		Run:            RunMetadata{Hostname: "h", Fields: []string{"path"}},
+	}
+}
+
+func TestEncodeManifestMatchesEncodingJSON(t *testing.T) {
+	for _, files := range [][]FileInfo{sampleManifest().Files, {}, nil} {
+		manifest := sampleManifest()
+		manifest.Files = files
+
+		var got bytes.Buffer
+		if err := encodeManifest(&got, manifest); err != nil {
+			t.Fatal(err)
+		}
+		want, err := json.MarshalIndent(manifest, "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.String() != string(want)+"\n" {
+			t.Errorf("streamed manifest differs from encoding/json:\n%s\nwant:\n%s", got.String(), want)
+		}
+	}
+}
+
+func TestEncodeManifestProjectsFields(t *testing.T) {
+	manifest := sampleManifest()
+	manifest.fields = fieldPath | fieldSHA256 | fieldBinary
+
+	var out bytes.Buffer
+	if err := encodeManifest(&out, manifest); err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		Files      []map[string]interface{} `json:"files"`
+		TotalFiles int64                    `json:"total_files"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatalf("projected manifest is not valid JSON: %v\n%s", err, out.String())
+	}
+	if decoded.TotalFiles != 3 {
+		t.Errorf("total_files = %d, want 3", decoded.TotalFiles)
+	}
+
+	var keys [][]string
+	for _, entry := range decoded.Files {
+		var names []string
+		for _, f := range fileFields {
+			if _, ok := entry[f.name]; ok {
+				names = append(names, f.name)
+			}
+		}
+		if len(names) != len(entry) {
+			t.Errorf("entry has unexpected keys: %v", entry)
+		}
+		keys = append(keys, names)
+	}
+	want := [][]string{{"path", "sha256"}, {"path", "sha256", "binary"}}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("projected keys = %v, want %v", keys, want)
+	}
+}
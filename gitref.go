@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GitSource records which commit a -git-ref manifest describes
+type GitSource struct {
+	Repo   string `json:"repo"`
+	Ref    string `json:"ref"`
+	Commit string `json:"commit"`
+}
+
+const (
+	gitModeSymlink   = "120000"
+	gitModeSubmodule = "160000"
+)
+
+type gitTreeEntry struct {
+	mode string
+	kind string
+	oid  string
+	size int64
+	path string
+}
+
+func gitOutput(repo string, args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"-C", repo}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// gitPermissions translates a tree entry mode into the permissions string
+// used for filesystem entries
+func gitPermissions(mode string) string {
+	switch mode {
+	case gitModeSymlink:
+		return (os.ModeSymlink | 0777).String()
+	case gitModeSubmodule:
+		return os.ModeDir.String()
+	}
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return ""
+	}
+	return os.FileMode(perm & 0777).String()
+}
+
+// listGitTree enumerates every entry of commit's tree. Submodules show up
+// as commit entries since ls-tree does not descend into them.
+func listGitTree(repo, commit string) ([]gitTreeEntry, error) {
+	cmd := exec.Command("git", "-C", repo, "ls-tree", "-r", "-z", "--full-tree", "--long", commit)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	var entries []gitTreeEntry
+	var parseErr error
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.IndexByte(data, 0); i >= 0 {
+			return i + 1, data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+	for scanner.Scan() {
+		// <mode> SP <type> SP <object> SP+ <size> TAB <path>
+		meta, path, ok := strings.Cut(scanner.Text(), "\t")
+		fields := strings.Fields(meta)
+		if !ok || len(fields) != 4 {
+			parseErr = fmt.Errorf("unexpected ls-tree output %q", scanner.Text())
+			break
+		}
+		entry := gitTreeEntry{mode: fields[0], kind: fields[1], oid: fields[2], path: path}
+		if fields[3] != "-" {
+			entry.size, _ = strconv.ParseInt(fields[3], 10, 64)
+		}
+		entries = append(entries, entry)
+	}
+	if parseErr == nil {
+		parseErr = scanner.Err()
+	}
+	io.Copy(io.Discard, stdout)
+
+	if err := cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("git ls-tree: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return entries, parseErr
+}
+
+// blobReader streams blob contents from a single long-lived cat-file process
+type blobReader struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+func newBlobReader(repo string) (*blobReader, error) {
+	cmd := exec.Command("git", "-C", repo, "cat-file", "--batch")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &blobReader{cmd: cmd, stdin: stdin, stdout: bufio.NewReaderSize(stdout, 64*1024)}, nil
+}
+
+// Read requests oid and hands its content to fn, which must not read past
+// the reader it is given. The rest of the blob is drained afterwards so the
+// stream stays in sync.
+func (br *blobReader) Read(oid string, fn func(io.Reader, int64) error) error {
+	if _, err := fmt.Fprintf(br.stdin, "%s\n", oid); err != nil {
+		return err
+	}
+
+	header, err := br.stdout.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(header)
+	if len(fields) == 2 && fields[1] == "missing" {
+		return fmt.Errorf("object %s missing from repository", oid)
+	}
+	if len(fields) != 3 {
+		return fmt.Errorf("unexpected cat-file header %q", strings.TrimSpace(header))
+	}
+	size, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return fmt.Errorf("unexpected cat-file header %q", strings.TrimSpace(header))
+	}
+
+	content := io.LimitReader(br.stdout, size)
+	fnErr := fn(content, size)
+	if _, err := io.Copy(io.Discard, content); err != nil {
+		return err
+	}
+	// Each object is followed by a newline
+	if _, err := br.stdout.Discard(1); err != nil {
+		return err
+	}
+	return fnErr
+}
+
+func (br *blobReader) Close() error {
+	br.stdin.Close()
+	return br.cmd.Wait()
+}
+
+// scanGitRef builds the manifest of the tree at ref without a checkout
+func scanGitRef(repo, ref string, opts scanOptions, verbose bool, phases *phaseTimer) (*scanResult, *GitSource, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return nil, nil, fmt.Errorf("-git-ref requires git on PATH: %w", err)
+	}
+
+	stopDiscovery := phases.Start("discovery")
+	commit, err := gitOutput(repo, "rev-parse", "--verify", "--end-of-options", ref+"^{commit}")
+	if err != nil {
+		stopDiscovery()
+		return nil, nil, fmt.Errorf("failed to resolve %s: %w", ref, err)
+	}
+	committed, err := gitOutput(repo, "log", "-1", "--format=%ct", commit)
+	if err != nil {
+		stopDiscovery()
+		return nil, nil, err
+	}
+	seconds, err := strconv.ParseInt(committed, 10, 64)
+	if err != nil {
+		stopDiscovery()
+		return nil, nil, fmt.Errorf("unexpected commit timestamp %q", committed)
+	}
+	commitTime := time.Unix(seconds, 0)
+
+	entries, err := listGitTree(repo, commit)
+	stopDiscovery()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	absRepo, err := filepath.Abs(repo)
+	if err != nil {
+		absRepo = repo
+	}
+	source := &GitSource{Repo: absRepo, Ref: ref, Commit: commit}
+	fmt.Printf("🔖 Commit: %s (%s)\n", commit, commitTime.UTC().Format(time.RFC3339))
+	fmt.Printf("📊 Found %d tree entries to process\n", len(entries))
+
+	// Symlink targets live in their blobs, so those are read even when
+	// nothing is hashed
+	needContent := opts.compute.Has(fieldSHA256) && !opts.dryRun
+	needBlobs := needContent
+	var totalBytes int64
+	for _, entry := range entries {
+		totalBytes += entry.size
+		if entry.mode == gitModeSymlink {
+			needBlobs = true
+		}
+	}
+
+	var blobs *blobReader
+	if needBlobs {
+		if blobs, err = newBlobReader(repo); err != nil {
+			return nil, nil, fmt.Errorf("failed to start git cat-file: %w", err)
+		}
+	}
+
+	progress := NewProgressTracker()
+	progress.SetExpectedBytes(totalBytes)
+	stopProcessing := phases.Start("processing")
+	result := &scanResult{total: int64(len(entries))}
+	for _, entry := range entries {
+		fileInfo := FileInfo{
+			Path:        entry.path,
+			Size:        entry.size,
+			Mtime:       commitTime.UTC().Format(time.RFC3339),
+			Permissions: gitPermissions(entry.mode),
+		}
+
+		switch {
+		case entry.mode == gitModeSubmodule:
+			fileInfo.Type = "submodule"
+			fileInfo.Target = entry.oid
+		case entry.kind != "blob":
+			result.failed = append(result.failed, FailedFile{Path: entry.path, Reason: "unexpected tree entry type " + entry.kind})
+			progress.Update(0, 1, 0)
+			continue
+		default:
+			if entry.mode == gitModeSymlink {
+				fileInfo.Type = "symlink"
+			}
+
+			var err error
+			if needContent || fileInfo.Type == "symlink" {
+				err = blobs.Read(entry.oid, func(r io.Reader, size int64) error {
+					if fileInfo.Type == "symlink" {
+						target, err := io.ReadAll(r)
+						if err != nil {
+							return err
+						}
+						fileInfo.Target = string(target)
+						r = bytes.NewReader(target)
+					}
+					if !needContent {
+						return nil
+					}
+					hash, err := hashReader(r)
+					fileInfo.SHA256 = hash
+					return err
+				})
+			}
+			if !needContent && opts.compute.Has(fieldSHA256) {
+				fileInfo.SHA256 = "dry-run-hash"
+			}
+			if err != nil {
+				result.failed = append(result.failed, FailedFile{Path: entry.path, Reason: err.Error(), Size: entry.size})
+				progress.Update(0, 1, 0)
+				if verbose {
+					fmt.Printf("❌ Failed: %s - %s\n", entry.path, err)
+				}
+				continue
+			}
+		}
+
+		opts.annotate(&fileInfo, commitTime)
+		result.files = append(result.files, fileInfo)
+		result.totalSize += fileInfo.Size
+		progress.Update(1, 0, fileInfo.Size)
+		if verbose {
+			fmt.Printf("✅ Processing: %s (%s)\n", fileInfo.Path, formatBytes(fileInfo.Size))
+		}
+	}
+
+	if blobs != nil {
+		if err := blobs.Close(); err != nil {
+			return nil, nil, fmt.Errorf("git cat-file: %w", err)
+		}
+	}
+	stopProcessing()
+
+	// Clear progress line
+	fmt.Print("\r" + strings.Repeat(" ", 100) + "\r")
+
+	result.processed, result.failedCount, _, result.elapsed = progress.FinalStats()
+	return result, source, nil
+}
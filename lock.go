@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Exit code for "another scan holds the lock", distinct from ordinary
+// failures so cron wrappers can tell the two apart (EX_TEMPFAIL).
+const exitLockHeld = 75
+
+var errLockHeld = errors.New("lock held by another process")
+
+// lockHolder is written into the lock file so a blocked run can say who it
+// is waiting for and a later run can recognise a holder that died.
+type lockHolder struct {
+	PID       int    `json:"pid"`
+	StartedAt string `json:"started_at"`
+	Hostname  string `json:"hostname"`
+}
+
+type lockHeldError struct {
+	path   string
+	holder *lockHolder
+}
+
+func (e *lockHeldError) Error() string {
+	if e.holder == nil {
+		return fmt.Sprintf("scan lock %s is held by another process", e.path)
+	}
+	return fmt.Sprintf("scan lock %s is held by pid %d on %s (started %s)",
+		e.path, e.holder.PID, e.holder.Hostname, e.holder.StartedAt)
+}
+
+func (e *lockHeldError) Unwrap() error { return errLockHeld }
+
+type scanLock struct {
+	path string
+	file *os.File
+	once sync.Once
+}
+
+// scanLockPath derives the lock location from where the manifest goes, or
+// from the scan root when writing to stdout, so that two runs racing on the
+// same artifact contend for the same lock.
+func scanLockPath(output, outputDir, root string) (string, error) {
+	switch {
+	case output != "":
+		abs, err := filepath.Abs(output)
+		if err != nil {
+			return "", err
+		}
+		return abs + ".lock", nil
+	case outputDir != "":
+		abs, err := filepath.Abs(outputDir)
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(abs, ".manifest.lock"), nil
+	default:
+		abs, err := filepath.Abs(root)
+		if err != nil {
+			return "", err
+		}
+		if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+			abs = resolved
+		}
+		sum := sha256.Sum256([]byte(abs))
+		return filepath.Join(os.TempDir(), fmt.Sprintf("manifest-generator-%x.lock", sum[:6])), nil
+	}
+}
+
+// acquireScanLock takes the advisory lock at path, polling for up to wait
+// while another process holds it. Only a live process can hold the kernel
+// lock, so a held lock is never broken, whatever pid the file names.
+func acquireScanLock(path string, wait time.Duration) (*scanLock, error) {
+	hostname, _ := os.Hostname()
+	deadline := time.Now().Add(wait)
+
+	for {
+		file, err := lockFile(path)
+		if err == nil {
+			// A holder that exits cleanly empties the file, so leftover
+			// content means the previous run died while holding it
+			if prev := readLockHolder(file); prev != nil && prev.PID != os.Getpid() {
+				fmt.Fprintf(os.Stderr, "⚠️  Breaking stale lock %s left by pid %d (started %s)\n",
+					path, prev.PID, prev.StartedAt)
+			}
+
+			lock := &scanLock{path: path, file: file}
+			holder := lockHolder{
+				PID:       os.Getpid(),
+				StartedAt: time.Now().UTC().Format(time.RFC3339),
+				Hostname:  hostname,
+			}
+			if err := lock.write(&holder); err != nil {
+				lock.Release()
+				return nil, fmt.Errorf("failed to write lock file: %w", err)
+			}
+			return lock, nil
+		}
+		if !errors.Is(err, errLockHeld) {
+			return nil, fmt.Errorf("failed to open lock file: %w", err)
+		}
+
+		if !time.Now().Before(deadline) {
+			return nil, &lockHeldError{path: path, holder: readLockHolderFile(path)}
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+func (l *scanLock) write(holder *lockHolder) error {
+	data, err := json.Marshal(holder)
+	if err != nil {
+		return err
+	}
+	if err := l.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := l.file.WriteAt(append(data, '\n'), 0); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// Release empties and unlocks the lock file. The file itself is left in
+// place: unlinking a locked file lets a waiter lock an orphaned inode while
+// a newcomer creates a fresh one.
+func (l *scanLock) Release() {
+	l.once.Do(func() {
+		l.file.Truncate(0)
+		unlockFile(l.file)
+		l.file.Close()
+	})
+}
+
+func readLockHolder(r io.ReaderAt) *lockHolder {
+	buf := make([]byte, 4096)
+	n, err := r.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return nil
+	}
+	var holder lockHolder
+	if n == 0 || json.Unmarshal(buf[:n], &holder) != nil || holder.PID <= 0 {
+		return nil
+	}
+	return &holder
+}
+
+func readLockHolderFile(path string) *lockHolder {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	return readLockHolder(file)
+}
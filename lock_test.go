@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcquireScanLockHeld(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.json.lock")
+	first, err := acquireScanLock(path, 0)
+	if err != nil {
+		t.Fatalf("first acquire: %v", err)
+	}
+	defer first.Release()
+
+	second, err := acquireScanLock(path, 0)
+	if err == nil {
+		second.Release()
+		t.Fatal("second acquire succeeded while the lock was held")
+	}
+	if !errors.Is(err, errLockHeld) {
+		t.Fatalf("got %v, want errLockHeld", err)
+	}
+	var held *lockHeldError
+	if !errors.As(err, &held) || held.holder == nil {
+		t.Fatalf("error %v does not name the holder", err)
+	}
+	if held.holder.PID != os.Getpid() {
+		t.Errorf("holder pid = %d, want %d", held.holder.PID, os.Getpid())
+	}
+}
+
+func TestAcquireScanLockWait(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.json.lock")
+	first, err := acquireScanLock(path, 0)
+	if err != nil {
+		t.Fatalf("first acquire: %v", err)
+	}
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		first.Release()
+	}()
+
+	second, err := acquireScanLock(path, 5*time.Second)
+	if err != nil {
+		t.Fatalf("acquire with -lock-wait: %v", err)
+	}
+	second.Release()
+}
+
+func TestAcquireScanLockStaleContent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.json.lock")
+	dead, _ := json.Marshal(lockHolder{PID: 1 << 30, StartedAt: "2020-01-01T00:00:00Z", Hostname: "elsewhere"})
+	if err := os.WriteFile(path, dead, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	stderr := captureStderr(t, func() {
+		lock, err := acquireScanLock(path, 0)
+		if err != nil {
+			t.Fatalf("acquire over stale content: %v", err)
+		}
+		lock.Release()
+	})
+	if !strings.Contains(stderr, "Breaking stale lock") || !strings.Contains(stderr, "1073741824") {
+		t.Errorf("missing stale lock warning, got %q", stderr)
+	}
+}
+
+func TestScanLockReleaseIdempotent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.json.lock")
+	lock, err := acquireScanLock(path, 0)
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	lock.Release()
+	lock.Release()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 0 {
+		t.Errorf("released lock file still has content %q", data)
+	}
+
+	again, err := acquireScanLock(path, 0)
+	if err != nil {
+		t.Fatalf("acquire after release: %v", err)
+	}
+	again.Release()
+}
+
+func captureStderr(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stderr
+	os.Stderr = w
+	defer func() { os.Stderr = saved }()
+
+	done := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		done <- string(data)
+	}()
+	fn()
+	w.Close()
+	return <-done
+}
+
+// silenceStdout discards stdout until the test ends
+func silenceStdout(t *testing.T) {
+	t.Helper()
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stdout
+	os.Stdout = devNull
+	t.Cleanup(func() {
+		os.Stdout = saved
+		devNull.Close()
+	})
+}
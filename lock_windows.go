@@ -0,0 +1,41 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+const errorSharingViolation syscall.Errno = 32
+
+// lockFile opens path without write sharing, so a second opener fails with
+// a sharing violation until this handle is closed. Read sharing stays on so
+// a blocked run can still report who holds the lock.
+func lockFile(path string) (*os.File, error) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+
+	handle, err := syscall.CreateFile(name,
+		syscall.GENERIC_READ|syscall.GENERIC_WRITE,
+		syscall.FILE_SHARE_READ,
+		nil,
+		syscall.OPEN_ALWAYS,
+		syscall.FILE_ATTRIBUTE_NORMAL,
+		0)
+	if err != nil {
+		if errors.Is(err, errorSharingViolation) {
+			return nil, errLockHeld
+		}
+		return nil, err
+	}
+	return os.NewFile(uintptr(handle), path), nil
+}
+
+// The exclusive handle is the lock; closing the file releases it
+func unlockFile(file *os.File) error {
+	return nil
+}
@@ -4,27 +4,36 @@ import (
 	"compress/gzip"
 	"context"
 	"crypto/sha256"
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"math"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 type FileInfo struct {
-	Path       string  `json:"path"`
-	Size       int64   `json:"size"`
-	Mtime      string  `json:"mtime"`
-	SHA256     string  `json:"sha256"`
-	TrustScore float64 `json:"trust_score"`
-	Agent      string  `json:"agent"`
+	Path        string      `json:"path"`
+	Size        int64       `json:"size"`
+	Mtime       string      `json:"mtime"`
+	SHA256      string      `json:"sha256"`
+	HashScheme  string      `json:"hash_scheme,omitempty"` // empty for a plain sha256 of the whole file
+	TrustScore  float64     `json:"trust_score"`
+	Agent       string      `json:"agent"`
+	Anomalies   []string    `json:"anomalies,omitempty"`
+	Layer       string      `json:"layer,omitempty"`
+	Type        string      `json:"type,omitempty"`
+	Permissions string      `json:"permissions,omitempty"`
+	Target      string      `json:"target,omitempty"` // symlink destination or submodule commit
+	Binary      *BinaryInfo `json:"binary,omitempty"`
 }
 
 type FailedFile struct {
@@ -34,23 +43,62 @@ type FailedFile struct {
 }
 
 type ManifestResult struct {
-	Files         []FileInfo   `json:"files"`
-	FailedFiles   []FailedFile `json:"failed_files"`
-	TotalFiles    int64        `json:"total_files"`
-	ProcessedFiles int64       `json:"processed_files"`
-	FailedCount   int64        `json:"failed_count"`
-	TotalSize     int64        `json:"total_size"`
-	ProcessingTime string      `json:"processing_time"`
-	SuccessRate   float64     `json:"success_rate"`
+	Files          []FileInfo       `json:"files"`
+	FailedFiles    []FailedFile     `json:"failed_files"`
+	TotalFiles     int64            `json:"total_files"`
+	ProcessedFiles int64            `json:"processed_files"`
+	FailedCount    int64            `json:"failed_count"`
+	TotalSize      int64            `json:"total_size"`
+	ProcessingTime string           `json:"processing_time"`
+	SuccessRate    float64          `json:"success_rate"`
+	AnomalyCounts  map[string]int64 `json:"anomaly_counts,omitempty"`
+	DeletedFiles   []DeletedFile    `json:"deleted_files,omitempty"`
+	Run            RunMetadata      `json:"run"`
+
+	fields fieldSet
+}
+
+type RunMetadata struct {
+	StartedAt string            `json:"started_at"`
+	Hostname  string            `json:"hostname"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Fields    []string          `json:"fields"`
+	Image     *ImageSource      `json:"image,omitempty"`
+	Git       *GitSource        `json:"git,omitempty"`
+	Timings   Timings           `json:"timings"`
+}
+
+// Throughput is smoothed over the last progressWindow seconds
+const progressWindow = 30
+
+type progressSample struct {
+	at        time.Time
+	processed int64
+	bytes     int64
+}
+
+type progressRates struct {
+	filesPerSec    float64
+	bytesPerSec    float64
+	avgFilesPerSec float64
+	avgBytesPerSec float64
+	eta            time.Duration // negative when the total is unknown
 }
 
 type ProgressTracker struct {
-	processed    int64
-	failed       int64
-	totalSize    int64
-	startTime    time.Time
-	lastPrint    time.Time
-	printMutex   sync.Mutex
+	processed     int64
+	failed        int64
+	totalSize     int64
+	expectedBytes int64
+	nextPrint     int64 // unix nanos; lets Update skip the mutex between prints
+	startTime     time.Time
+	lastPrint     time.Time
+	printMutex    sync.Mutex
+
+	// Ring of one-second samples, guarded by printMutex
+	samples     [progressWindow + 1]progressSample
+	sampleCount int
+	sampleNext  int
 }
 
 type CircuitBreaker struct {
@@ -62,17 +110,17 @@ type CircuitBreaker struct {
 }
 
 type WorkerPool struct {
-	workers     int
-	jobs        chan string
-	results     chan FileInfo
-	errors      chan FailedFile
-	wg          sync.WaitGroup
-	ctx         context.Context
-	cancel      context.CancelFunc
-	basePath    string
-	dryRun      bool
-	progress    *ProgressTracker
-	breaker     *CircuitBreaker
+	workers  int
+	jobs     chan string
+	results  chan FileInfo
+	errors   chan FailedFile
+	wg       sync.WaitGroup
+	ctx      context.Context
+	cancel   context.CancelFunc
+	basePath string
+	opts     scanOptions
+	progress *ProgressTracker
+	breaker  *CircuitBreaker
 }
 
 func NewCircuitBreaker(threshold int64, timeout time.Duration) *CircuitBreaker {
@@ -105,37 +153,142 @@ func (cb *CircuitBreaker) Call(fn func() error) error {
 }
 
 func NewProgressTracker() *ProgressTracker {
-	return &ProgressTracker{
-		startTime: time.Now(),
-		lastPrint: time.Now(),
+	return newProgressTracker(time.Now())
+}
+
+// newProgressTracker and update take the clock reading explicitly so the
+// window can be driven with synthetic sample sequences
+func newProgressTracker(now time.Time) *ProgressTracker {
+	pt := &ProgressTracker{
+		startTime: now,
+		lastPrint: now,
+		nextPrint: now.Add(time.Second).UnixNano(),
 	}
+	pt.recordSample(now)
+	return pt
+}
+
+// SetExpectedBytes enables the ETA once the total work is known
+func (pt *ProgressTracker) SetExpectedBytes(bytes int64) {
+	atomic.StoreInt64(&pt.expectedBytes, bytes)
 }
 
 func (pt *ProgressTracker) Update(processed, failed, size int64) {
+	pt.update(processed, failed, size, time.Now())
+}
+
+func (pt *ProgressTracker) update(processed, failed, size int64, now time.Time) {
 	atomic.AddInt64(&pt.processed, processed)
 	atomic.AddInt64(&pt.failed, failed)
 	atomic.AddInt64(&pt.totalSize, size)
 
+	// Every worker calls Update, so only the first caller after each
+	// second takes the lock
+	if now.UnixNano() < atomic.LoadInt64(&pt.nextPrint) {
+		return
+	}
+
 	pt.printMutex.Lock()
 	defer pt.printMutex.Unlock()
 
-	now := time.Now()
 	if now.Sub(pt.lastPrint) >= time.Second {
-		pt.printProgress()
+		pt.recordSample(now)
+		pt.printProgress(now)
 		pt.lastPrint = now
+		atomic.StoreInt64(&pt.nextPrint, now.Add(time.Second).UnixNano())
+	}
+}
+
+// recordSample appends the current counters to the window; the caller
+// holds printMutex
+func (pt *ProgressTracker) recordSample(now time.Time) {
+	pt.samples[pt.sampleNext] = progressSample{
+		at:        now,
+		processed: atomic.LoadInt64(&pt.processed),
+		bytes:     atomic.LoadInt64(&pt.totalSize),
+	}
+	pt.sampleNext = (pt.sampleNext + 1) % len(pt.samples)
+	if pt.sampleCount < len(pt.samples) {
+		pt.sampleCount++
 	}
 }
 
-func (pt *ProgressTracker) printProgress() {
+// rates computes windowed and lifetime throughput at now; the caller holds
+// printMutex
+func (pt *ProgressTracker) rates(now time.Time) progressRates {
+	processed := atomic.LoadInt64(&pt.processed)
+	bytes := atomic.LoadInt64(&pt.totalSize)
+	r := progressRates{eta: -1}
+
+	if elapsed := now.Sub(pt.startTime).Seconds(); elapsed > 0 {
+		r.avgFilesPerSec = float64(processed) / elapsed
+		r.avgBytesPerSec = float64(bytes) / elapsed
+	}
+
+	// Measure from the oldest sample still inside the window. If updates
+	// stalled for longer than the window, the newest sample is the best
+	// baseline and the rate drops toward zero as it should.
+	cutoff := now.Add(-progressWindow * time.Second)
+	var base, newest *progressSample
+	for i := 0; i < pt.sampleCount; i++ {
+		s := &pt.samples[i]
+		if newest == nil || s.at.After(newest.at) {
+			newest = s
+		}
+		if !s.at.Before(cutoff) && (base == nil || s.at.Before(base.at)) {
+			base = s
+		}
+	}
+	if base == nil {
+		base = newest
+	}
+
+	if base != nil {
+		if span := now.Sub(base.at).Seconds(); span >= 1 {
+			r.filesPerSec = float64(processed-base.processed) / span
+			r.bytesPerSec = float64(bytes-base.bytes) / span
+		} else {
+			r.filesPerSec, r.bytesPerSec = r.avgFilesPerSec, r.avgBytesPerSec
+		}
+	}
+
+	if expected := atomic.LoadInt64(&pt.expectedBytes); expected > 0 && r.bytesPerSec > 0 {
+		remaining := expected - bytes
+		if remaining < 0 {
+			remaining = 0
+		}
+		r.eta = time.Duration(float64(remaining) / r.bytesPerSec * float64(time.Second))
+	}
+	return r
+}
+
+// roundETA keeps the estimate readable without implying false precision
+func roundETA(d time.Duration) time.Duration {
+	switch {
+	case d >= time.Hour:
+		return d.Round(time.Minute)
+	case d >= time.Minute:
+		return d.Round(10 * time.Second)
+	default:
+		return d.Round(time.Second)
+	}
+}
+
+func (pt *ProgressTracker) printProgress(now time.Time) {
 	processed := atomic.LoadInt64(&pt.processed)
 	failed := atomic.LoadInt64(&pt.failed)
 	totalSize := atomic.LoadInt64(&pt.totalSize)
-	elapsed := time.Since(pt.startTime)
+	elapsed := now.Sub(pt.startTime)
 
-	rate := float64(processed) / elapsed.Seconds()
-	
-	fmt.Printf("\r📊 Processed: %d | ❌ Failed: %d | 📦 Size: %s | ⚡ Rate: %.1f files/sec | ⏱️  %v",
-		processed, failed, formatBytes(totalSize), rate, elapsed.Round(time.Second))
+	r := pt.rates(now)
+	eta := ""
+	if r.eta >= 0 {
+		eta = fmt.Sprintf(" | ⏳ ETA %v", roundETA(r.eta))
+	}
+
+	fmt.Printf("\r📊 Processed: %d | ❌ Failed: %d | 📦 Size: %s | ⚡ Rate: %.1f files/sec, %s/s (avg %.1f files/sec)%s | ⏱️  %v",
+		processed, failed, formatBytes(totalSize), r.filesPerSec, formatBytes(int64(r.bytesPerSec)),
+		r.avgFilesPerSec, eta, elapsed.Round(time.Second))
 }
 
 func (pt *ProgressTracker) FinalStats() (int64, int64, int64, time.Duration) {
@@ -158,7 +311,33 @@ func formatBytes(bytes int64) string {
 	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
 }
 
-func NewWorkerPool(workers int, basePath string, dryRun bool) *WorkerPool {
+// scanOptions controls what is computed for each entry
+type scanOptions struct {
+	dryRun    bool
+	compute   fieldSet
+	anomalies *anomalyChecker
+
+	// Binary inspection needs random access, so only filesystem scans use it
+	inspectBinaries bool
+	importLimit     int
+
+	// Set by -large-file-chunking; hashes through a shared I/O slot pool
+	chunker *chunkHasher
+}
+
+// annotate fills in the derived fields of an entry whose path and size are
+// already known. Fields nobody asked for are never computed.
+func (opts *scanOptions) annotate(fileInfo *FileInfo, mtime time.Time) {
+	if opts.compute.Has(fieldTrustScore) {
+		fileInfo.TrustScore = calculateTrustScore(fileInfo.Path, fileInfo.Size, fileInfo.Binary)
+	}
+	if opts.compute.Has(fieldAgent) {
+		fileInfo.Agent = classifyAgent(fileInfo.Path)
+	}
+	fileInfo.Anomalies = opts.anomalies.Check(mtime)
+}
+
+func NewWorkerPool(workers int, basePath string, opts scanOptions) *WorkerPool {
 	ctx, cancel := context.WithCancel(context.Background())
 	return &WorkerPool{
 		workers:  workers,
@@ -168,7 +347,7 @@ func NewWorkerPool(workers int, basePath string, dryRun bool) *WorkerPool {
 		ctx:      ctx,
 		cancel:   cancel,
 		basePath: basePath,
-		dryRun:   dryRun,
+		opts:     opts,
 		progress: NewProgressTracker(),
 		breaker:  NewCircuitBreaker(100, 30*time.Second),
 	}
@@ -250,14 +429,27 @@ func (wp *WorkerPool) processFile(filePath string) error {
 		}
 	}
 
-	var hash string
-	if !wp.dryRun {
-		hash, err = calculateSHA256(absPath)
-		if err != nil {
-			return fmt.Errorf("failed to calculate hash: %w", err)
+	// Sniff the binary header while hashing rather than reading it twice
+	inspect := wp.opts.inspectBinaries && wp.opts.compute.Has(fieldBinary)
+	var head *fileHeader
+	if inspect {
+		head = &fileHeader{}
+	}
+
+	var hash, scheme string
+	if wp.opts.compute.Has(fieldSHA256) {
+		if !wp.opts.dryRun {
+			if wp.opts.chunker != nil {
+				hash, scheme, err = wp.opts.chunker.Hash(absPath, info.Size(), head)
+			} else {
+				hash, err = calculateSHA256(absPath, head)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to calculate hash: %w", err)
+			}
+		} else {
+			hash = "dry-run-hash"
 		}
-	} else {
-		hash = "dry-run-hash"
 	}
 
 	relPath, err := getRelativePath(wp.basePath, absPath)
@@ -266,13 +458,22 @@ func (wp *WorkerPool) processFile(filePath string) error {
 	}
 
 	fileInfo := FileInfo{
-		Path:       relPath,
-		Size:       info.Size(),
-		Mtime:      info.ModTime().UTC().Format(time.RFC3339),
-		SHA256:     hash,
-		TrustScore: calculateTrustScore(relPath, info.Size()),
-		Agent:      classifyAgent(relPath),
+		Path:        relPath,
+		Size:        info.Size(),
+		Mtime:       info.ModTime().UTC().Format(time.RFC3339),
+		SHA256:      hash,
+		HashScheme:  scheme,
+		Permissions: info.Mode().String(),
+	}
+	if inspect {
+		if hash == "" || wp.opts.dryRun {
+			err = head.Fill(absPath)
+		}
+		if err == nil {
+			fileInfo.Binary = inspectBinary(absPath, head.Bytes(), wp.opts.importLimit)
+		}
 	}
+	wp.opts.annotate(&fileInfo, info.ModTime())
 
 	wp.results <- fileInfo
 	wp.progress.Update(1, 0, info.Size())
@@ -294,22 +495,31 @@ func getRelativePath(basePath, targetPath string) (string, error) {
 	return filepath.Rel(absBase, absTarget)
 }
 
-func calculateSHA256(filePath string) (string, error) {
+// calculateSHA256 hashes the file, copying its first bytes into head when set
+func calculateSHA256(filePath string, head *fileHeader) (string, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return "", err
 	}
 	defer file.Close()
 
+	if head != nil {
+		return hashReader(io.TeeReader(file, head))
+	}
+	return hashReader(file)
+}
+
+// hashReader is the hash pipeline shared by every input source
+func hashReader(r io.Reader) (string, error) {
 	hash := sha256.New()
-	if _, err := io.Copy(hash, file); err != nil {
+	if _, err := io.Copy(hash, r); err != nil {
 		return "", err
 	}
 
 	return fmt.Sprintf("%x", hash.Sum(nil)), nil
 }
 
-func calculateTrustScore(path string, size int64) float64 {
+func calculateTrustScore(path string, size int64, bin *BinaryInfo) float64 {
 	score := 0.5 // Base score
 
 	// File type bonuses
@@ -323,6 +533,11 @@ func calculateTrustScore(path string, size int64) float64 {
 		score -= 0.3
 	}
 
+	// A code signature offsets most of the executable penalty
+	if bin != nil && bin.Signed != nil && *bin.Signed {
+		score += 0.2
+	}
+
 	// Size penalties
 	if size > 100*1024*1024 { // > 100MB
 		score -= 0.2
@@ -394,10 +609,22 @@ func classifyAgent(path string) string {
 	}
 }
 
-func discoverFiles(rootPath string) ([]string, error) {
+// discoverFiles returns the files to scan and their combined size
+func discoverFiles(rootPath string) ([]string, int64, error) {
 	var files []string
-	
-	err := filepath.Walk(rootPath, func(path string, info os.FileInfo, err error) error {
+	var totalBytes int64
+
+	err := walkFiles(rootPath, func(absPath string, info os.FileInfo) {
+		files = append(files, absPath)
+		totalBytes += info.Size()
+	})
+
+	return files, totalBytes, err
+}
+
+// walkFiles calls fn for every file under rootPath that a scan would include
+func walkFiles(rootPath string, fn func(absPath string, info os.FileInfo)) error {
+	return filepath.Walk(rootPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return nil // Continue despite errors
 		}
@@ -418,63 +645,57 @@ func discoverFiles(rootPath string) ([]string, error) {
 			return fmt.Errorf("failed to get absolute path for %s: %w", path, err)
 		}
 
-		files = append(files, absPath)
+		fn(absPath, info)
 		return nil
 	})
-
-	return files, err
 }
 
-func main() {
-	// Command line flags
-	var (
-		dirFlag     = flag.String("dir", ".", "Directory to scan")
-		outputFlag  = flag.String("output", "", "Output file (default: stdout)")
-		workersFlag = flag.Int("workers", runtime.NumCPU(), "Number of worker goroutines")
-		dryRunFlag  = flag.Bool("dry-run", false, "Skip hash calculation for speed testing")
-		compressFlag = flag.Bool("compress", false, "Compress output with gzip")
-		verboseFlag = flag.Bool("verbose", false, "Enable verbose logging")
-	)
-	flag.Parse()
-
-	fmt.Printf("🚀 Starting manifest generation...\n")
-	fmt.Printf("📁 Directory: %s\n", *dirFlag)
-	fmt.Printf("👥 Workers: %d\n", *workersFlag)
-	if *dryRunFlag {
-		fmt.Printf("🏃 Dry run mode: enabled\n")
-	}
+// scanResult is what an input source hands back for the manifest
+type scanResult struct {
+	files       []FileInfo
+	failed      []FailedFile
+	deleted     []DeletedFile
+	total       int64
+	processed   int64
+	failedCount int64
+	totalSize   int64
+	elapsed     time.Duration
+}
 
+// scanDirectory discovers the files under dir and runs them through the worker pool
+func scanDirectory(dir string, workers int, opts scanOptions, verbose bool, phases *phaseTimer) (*scanResult, error) {
 	// Discover all files
 	fmt.Printf("🔍 Discovering files...\n")
-	files, err := discoverFiles(*dirFlag)
+	stopDiscovery := phases.Start("discovery")
+	files, totalBytes, err := discoverFiles(dir)
+	stopDiscovery()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error discovering files: %v\n", err)
-		os.Exit(1)
+		return nil, err
 	}
-
 	if len(files) == 0 {
-		fmt.Printf("⚠️  No files found in directory: %s\n", *dirFlag)
-		os.Exit(1)
+		return &scanResult{}, nil
 	}
 
 	fmt.Printf("📊 Found %d files to process\n", len(files))
-	fmt.Printf("💪 Worker pool initialized with %d workers\n", *workersFlag)
+	fmt.Printf("💪 Worker pool initialized with %d workers\n", workers)
 
 	// Create worker pool
-	wp := NewWorkerPool(*workersFlag, *dirFlag, *dryRunFlag)
+	wp := NewWorkerPool(workers, dir, opts)
+	wp.progress.SetExpectedBytes(totalBytes)
+	stopProcessing := phases.Start("processing")
 	wp.Start()
 
 	// Start result collection
 	var results []FileInfo
 	var failed []FailedFile
 	var resultWg sync.WaitGroup
-	
+
 	resultWg.Add(1)
 	go func() {
 		defer resultWg.Done()
 		for result := range wp.results {
 			results = append(results, result)
-			if *verboseFlag {
+			if verbose {
 				fmt.Printf("✅ Processing: %s (%s)\n", result.Path, formatBytes(result.Size))
 			}
 		}
@@ -485,7 +706,7 @@ func main() {
 		defer resultWg.Done()
 		for failure := range wp.errors {
 			failed = append(failed, failure)
-			if *verboseFlag {
+			if verbose {
 				fmt.Printf("❌ Failed: %s - %s\n", failure.Path, failure.Reason)
 			}
 		}
@@ -499,13 +720,287 @@ func main() {
 	// Wait for completion
 	wp.Stop()
 	resultWg.Wait()
+	stopProcessing()
 
 	// Clear progress line
-	fmt.Printf("\r" + strings.Repeat(" ", 100) + "\r")
+	fmt.Print("\r" + strings.Repeat(" ", 100) + "\r")
 
-	// Final statistics
 	processed, failedCount, totalSize, elapsed := wp.progress.FinalStats()
-	successRate := float64(processed) / float64(len(files)) * 100
+	return &scanResult{
+		files:       results,
+		failed:      failed,
+		total:       int64(len(files)),
+		processed:   processed,
+		failedCount: failedCount,
+		totalSize:   totalSize,
+		elapsed:     elapsed,
+	}, nil
+}
+
+var (
+	exitHooks []func()
+	exitOnce  sync.Once
+)
+
+// atExit registers cleanup that must run however the process ends
+func atExit(fn func()) {
+	exitHooks = append(exitHooks, fn)
+}
+
+// exit runs the registered cleanup (newest first) before terminating, since
+// os.Exit skips deferred calls
+func exit(code int) {
+	exitOnce.Do(func() {
+		for i := len(exitHooks) - 1; i >= 0; i-- {
+			exitHooks[i]()
+		}
+	})
+	os.Exit(code)
+}
+
+func main() {
+	// Command line flags
+	var (
+		dirFlag          = flag.String("dir", ".", "Directory to scan")
+		outputFlag       = flag.String("output", "", "Output file (default: stdout)")
+		workersFlag      = flag.Int("workers", runtime.NumCPU(), "Number of worker goroutines")
+		dryRunFlag       = flag.Bool("dry-run", false, "Skip hash calculation for speed testing")
+		compressFlag     = flag.Bool("compress", false, "Compress output with gzip")
+		verboseFlag      = flag.Bool("verbose", false, "Enable verbose logging")
+		outputDirFlag    = flag.String("output-dir", "", "Write timestamped manifests into this directory")
+		templateFlag     = flag.String("output-template", defaultOutputTemplate, "Manifest name template for -output-dir ({date}, {hostname}, {label:NAME})")
+		keepLastFlag     = flag.Int("keep-last", 0, "Keep only the newest N manifests in -output-dir (0 keeps all)")
+		lockWaitFlag     = flag.Duration("lock-wait", 0, "How long to wait for a concurrent scan of the same target to finish")
+		labels           = labelFlag{}
+		sortFlag         sortSpec
+		fieldsSel        fieldsFlag
+		minMtimeFlag     = flag.String("min-plausible-mtime", defaultMinPlausibleMtime, "Flag mtimes older than this date (YYYY-MM-DD or RFC3339)")
+		skewFlag         = flag.Duration("mtime-skew-tolerance", 5*time.Minute, "Clock skew allowed before an mtime counts as in the future")
+		noAnomalyFlag    = flag.Bool("no-anomaly-checks", false, "Skip timestamp anomaly checks")
+		ociFlag          = flag.String("input-oci", "", "Scan a docker-save tarball or OCI layout directory instead of -dir")
+		ociDeletedFlag   = flag.Bool("oci-list-deleted", false, "List files removed by layer whiteouts in the manifest")
+		gitRefFlag       = flag.String("git-ref", "", "Scan the tree of this commit/tag/branch in the -dir repository without a checkout")
+		inspectFlag      = flag.Bool("inspect-binaries", false, "Extract ELF/PE/Mach-O metadata for executables (directory scans only)")
+		importLimitFlag  = flag.Int("binary-import-limit", defaultBinaryImportLimit, "Maximum imported libraries listed per binary")
+		planFlag         = flag.Bool("plan", false, "Estimate scope and duration without hashing everything or writing a manifest")
+		planOutFlag      = flag.String("plan-out", "", "Write the -plan report as JSON to this file")
+		planSampleFlag   = flag.Int("plan-sample", defaultPlanSample, "Files hashed by the -plan timing probe")
+		planTopFlag      = flag.Int("plan-top", defaultPlanTop, "Largest files listed by -plan")
+		planBaselineFlag = flag.String("plan-baseline", "", "Earlier manifest used by -plan to count unchanged files")
+		chunkingFlag     = flag.Bool("large-file-chunking", false, "Hash files above -chunk-threshold as parallel chunks (sha256-tree digest, directory scans only)")
+		verifyFlag       = flag.String("verify", "", "Rehash the files of this manifest under -dir and report mismatches")
+		chunkThreshold   = byteSizeFlag(defaultChunkThreshold)
+		chunkSize        = byteSizeFlag(defaultChunkSize)
+	)
+	flag.Var(labels, "label", "Run label as key=value (repeatable)")
+	flag.Var(&fieldsSel, "fields", "Comma-separated FileInfo fields to emit (path is always included; default all)")
+	flag.Var(&chunkThreshold, "chunk-threshold", "Smallest file hashed in chunks with -large-file-chunking")
+	flag.Var(&chunkSize, "chunk-size", "Chunk size for -large-file-chunking")
+	flag.Var(&sortFlag, "sort", "Order files by key[:asc|desc] where key is path, size, mtime or trust (ties broken by path)")
+	flag.Parse()
+
+	startTime := time.Now()
+
+	mtimeFloor, err := parsePlausibleFloor(*minMtimeFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+
+	// Plan mode only reads: no lock, no output directory, no manifest
+	if *planFlag {
+		if *ociFlag != "" || *gitRefFlag != "" {
+			fmt.Fprintf(os.Stderr, "Error: -plan only supports directory scans\n")
+			exit(1)
+		}
+		fmt.Printf("🧭 Planning scan of %s...\n", *dirFlag)
+		report, err := buildPlan(*dirFlag, *workersFlag, *planSampleFlag, *planTopFlag, *planBaselineFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error building plan: %v\n", err)
+			exit(1)
+		}
+		report.Print()
+		if *planOutFlag != "" {
+			if err := writePlan(*planOutFlag, report); err != nil {
+				fmt.Fprintf(os.Stderr, "Error writing plan: %v\n", err)
+				exit(1)
+			}
+			fmt.Printf("📄 Plan written to: %s\n", *planOutFlag)
+		}
+		return
+	}
+
+	// Verification only reads too, and checks whatever scheme each entry declares
+	if *verifyFlag != "" {
+		fmt.Printf("🔎 Verifying %s against %s...\n", *verifyFlag, *dirFlag)
+		report, err := verifyManifest(*dirFlag, *verifyFlag, *workersFlag, *verboseFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error verifying manifest: %v\n", err)
+			exit(1)
+		}
+		report.Print()
+		if !report.OK() {
+			exit(1)
+		}
+		return
+	}
+
+	if *keepLastFlag < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -keep-last must not be negative\n")
+		exit(1)
+	}
+
+	var outTmpl *outputTemplate
+	if *outputDirFlag != "" {
+		if *outputFlag != "" {
+			fmt.Fprintf(os.Stderr, "Error: -output and -output-dir are mutually exclusive\n")
+			exit(1)
+		}
+		if err := os.MkdirAll(*outputDirFlag, 0755); err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating output directory: %v\n", err)
+			exit(1)
+		}
+		var err error
+		outTmpl, err = newOutputTemplate(*outputDirFlag, *templateFlag, *compressFlag, labels)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(1)
+		}
+	} else if *keepLastFlag != 0 {
+		fmt.Fprintf(os.Stderr, "Error: -keep-last requires -output-dir\n")
+		exit(1)
+	}
+
+	if *ociFlag != "" && *gitRefFlag != "" {
+		fmt.Fprintf(os.Stderr, "Error: -input-oci and -git-ref are mutually exclusive\n")
+		exit(1)
+	}
+
+	scanRoot := *dirFlag
+	if *ociFlag != "" {
+		scanRoot = *ociFlag
+	}
+
+	lockPath, err := scanLockPath(*outputFlag, *outputDirFlag, scanRoot)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error resolving lock path: %v\n", err)
+		exit(1)
+	}
+	lock, err := acquireScanLock(lockPath, *lockWaitFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "🔒 %v\n", err)
+		if errors.Is(err, errLockHeld) {
+			exit(exitLockHeld)
+		}
+		exit(1)
+	}
+	atExit(lock.Release)
+	defer lock.Release()
+
+	// Manifest names only resolve to the second, so a clash is caught here
+	// rather than after a full scan
+	if outTmpl != nil {
+		for _, path := range []string{outTmpl.Path(startTime), outTmpl.FailedPath(startTime)} {
+			if _, err := os.Stat(path); err == nil {
+				fmt.Fprintf(os.Stderr, "Error: output file already exists: %s\n", path)
+				exit(1)
+			}
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		fmt.Fprintf(os.Stderr, "\n🛑 Received %v, releasing lock and exiting\n", sig)
+		if s, ok := sig.(syscall.Signal); ok {
+			exit(128 + int(s))
+		}
+		exit(1)
+	}()
+
+	fmt.Printf("🚀 Starting manifest generation...\n")
+	if *ociFlag != "" {
+		fmt.Printf("📦 Image: %s\n", *ociFlag)
+	} else if *gitRefFlag != "" {
+		fmt.Printf("📁 Repository: %s @ %s\n", *dirFlag, *gitRefFlag)
+	} else {
+		fmt.Printf("📁 Directory: %s\n", *dirFlag)
+	}
+	fmt.Printf("👥 Workers: %d\n", *workersFlag)
+	if *dryRunFlag {
+		fmt.Printf("🏃 Dry run mode: enabled\n")
+	}
+
+	var phases phaseTimer
+
+	// Sorting by trust needs the score even when it is not emitted
+	fields := fieldsSel.Fields()
+	compute := fields
+	if sortFlag.Key() == "trust" {
+		compute |= fieldTrustScore
+	}
+	// A digest is meaningless without the scheme that produced it
+	if fields.Has(fieldSHA256) {
+		fields |= fieldHashScheme
+		compute |= fieldHashScheme
+	}
+	// Trust scoring reads the signature bit
+	if *inspectFlag && compute.Has(fieldTrustScore) {
+		compute |= fieldBinary
+	}
+
+	opts := scanOptions{
+		dryRun:          *dryRunFlag,
+		compute:         compute,
+		inspectBinaries: *inspectFlag,
+		importLimit:     *importLimitFlag,
+	}
+	if *chunkingFlag {
+		opts.chunker = newChunkHasher(int64(chunkThreshold), int64(chunkSize), *workersFlag)
+	}
+	if !*noAnomalyFlag {
+		opts.anomalies = newAnomalyChecker(startTime, mtimeFloor, *skewFlag)
+	}
+
+	var scan *scanResult
+	var image *ImageSource
+	var gitSource *GitSource
+	switch {
+	case *ociFlag != "":
+		scan, image, err = scanImage(*ociFlag, opts, *ociDeletedFlag, &phases)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error scanning image: %v\n", err)
+			exit(1)
+		}
+	case *gitRefFlag != "":
+		scan, gitSource, err = scanGitRef(*dirFlag, *gitRefFlag, opts, *verboseFlag, &phases)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error scanning git ref: %v\n", err)
+			exit(1)
+		}
+	default:
+		scan, err = scanDirectory(*dirFlag, *workersFlag, opts, *verboseFlag, &phases)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error discovering files: %v\n", err)
+			exit(1)
+		}
+	}
+	if scan.total == 0 {
+		fmt.Printf("⚠️  No files found in: %s\n", scanRoot)
+		exit(1)
+	}
+
+	results, failed := scan.files, scan.failed
+	processed, failedCount, totalSize, elapsed := scan.processed, scan.failedCount, scan.totalSize, scan.elapsed
+	successRate := float64(processed) / float64(scan.total) * 100
+
+	anomalyCounts := make(map[string]int64)
+	for _, result := range results {
+		for _, anomaly := range result.Anomalies {
+			anomalyCounts[anomaly]++
+		}
+	}
 
 	fmt.Printf("\n=== FINAL RESULTS ===\n")
 	fmt.Printf("✅ Processed: %d files\n", processed)
@@ -514,55 +1009,113 @@ func main() {
 	fmt.Printf("📦 Total Size: %s\n", formatBytes(totalSize))
 	fmt.Printf("⚡ Total Time: %v\n", elapsed.Round(time.Millisecond))
 	fmt.Printf("🔥 Processing Rate: %.1f files/sec\n", float64(processed)/elapsed.Seconds())
+	if len(anomalyCounts) > 0 {
+		fmt.Printf("🕰️  Timestamp anomalies: %s\n", formatAnomalyCounts(anomalyCounts))
+	}
+
+	stopSorting := phases.Start("sorting")
+	sortFiles(results, sortFlag.Compare())
+	stopSorting()
 
 	// Generate final manifest
+	hostname, _ := os.Hostname()
 	manifest := ManifestResult{
 		Files:          results,
 		FailedFiles:    failed,
-		TotalFiles:     int64(len(files)),
+		TotalFiles:     scan.total,
 		ProcessedFiles: processed,
 		FailedCount:    failedCount,
 		TotalSize:      totalSize,
 		ProcessingTime: elapsed.String(),
 		SuccessRate:    successRate,
+		AnomalyCounts:  anomalyCounts,
+		DeletedFiles:   scan.deleted,
+		Run: RunMetadata{
+			StartedAt: startTime.UTC().Format(time.RFC3339),
+			Hostname:  hostname,
+			Labels:    labels,
+			Fields:    fields.Names(),
+			Image:     image,
+			Git:       gitSource,
+			Timings:   phases.Timings(),
+		},
+		fields: fields,
 	}
 
 	// Output results
-	var output io.Writer = os.Stdout
-	if *outputFlag != "" {
+	stopEncoding := phases.Start("encoding")
+	switch {
+	case outTmpl != nil:
+		// A run below the success threshold keeps its manifest under a name
+		// retention ignores, so it can never displace the previous good ones
+		outputPath := outTmpl.Path(startTime)
+		if successRate < 80 {
+			outputPath = outTmpl.FailedPath(startTime)
+		}
+		if err := writeManifestFile(outputPath, *compressFlag, &manifest); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing manifest: %v\n", err)
+			exit(1)
+		}
+		stopEncoding()
+		fmt.Printf("📄 Output written to: %s\n", outputPath)
+
+		if successRate >= 80 {
+			if err := outTmpl.Rotate(*keepLastFlag); err != nil {
+				fmt.Fprintf(os.Stderr, "Error rotating manifests: %v\n", err)
+				exit(1)
+			}
+		} else {
+			fmt.Printf("⚠️  Skipping latest/retention update for failed run\n")
+		}
+
+	case *outputFlag != "":
 		file, err := os.Create(*outputFlag)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error creating output file: %v\n", err)
-			os.Exit(1)
+			exit(1)
 		}
-		defer file.Close()
 
+		var output io.Writer = file
+		var gzWriter *gzip.Writer
 		if *compressFlag {
-			gzWriter := gzip.NewWriter(file)
-			defer gzWriter.Close()
+			gzWriter = gzip.NewWriter(file)
 			output = gzWriter
-		} else {
-			output = file
 		}
-	}
-
-	encoder := json.NewEncoder(output)
-	encoder.SetIndent("", "  ")
-	if err := encoder.Encode(manifest); err != nil {
-		fmt.Fprintf(os.Stderr, "Error encoding JSON: %v\n", err)
-		os.Exit(1)
-	}
 
-	if *outputFlag != "" {
+		if err := encodeManifest(output, &manifest); err != nil {
+			fmt.Fprintf(os.Stderr, "Error encoding JSON: %v\n", err)
+			exit(1)
+		}
+		// Close explicitly: the exit paths below skip deferred calls
+		if gzWriter != nil {
+			if err := gzWriter.Close(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error finishing compression: %v\n", err)
+				exit(1)
+			}
+		}
+		if err := file.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error closing output file: %v\n", err)
+			exit(1)
+		}
+		stopEncoding()
 		fmt.Printf("📄 Output written to: %s\n", *outputFlag)
-		if *compressFlag {
-			fmt.Printf("🗜️  Compression: enabled\n")
+
+	default:
+		if err := encodeManifest(os.Stdout, &manifest); err != nil {
+			fmt.Fprintf(os.Stderr, "Error encoding JSON: %v\n", err)
+			exit(1)
 		}
+		stopEncoding()
+	}
+
+	if *compressFlag && (*outputFlag != "" || outTmpl != nil) {
+		fmt.Printf("🗜️  Compression: enabled\n")
 	}
+	fmt.Printf("⏱️  Phases: %s\n", phases.Summary())
 
 	if successRate < 80 {
 		fmt.Printf("⚠️  Low success rate detected. Check error messages above.\n")
-		os.Exit(1)
+		exit(1)
 	}
 
 	fmt.Printf("🎉 Manifest generation completed successfully!\n")
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ImageSource records the container image a manifest describes
+type ImageSource struct {
+	Input    string   `json:"input"`
+	Format   string   `json:"format"`
+	Config   string   `json:"config,omitempty"`
+	RepoTags []string `json:"repo_tags,omitempty"`
+	Layers   []string `json:"layers"`
+}
+
+// DeletedFile is a lower-layer file hidden by a whiteout in a later layer
+type DeletedFile struct {
+	Path         string `json:"path"`
+	DeletedBy    string `json:"deleted_by"`
+	IntroducedBy string `json:"introduced_by"`
+}
+
+type imageLayer struct {
+	digest string
+	open   func() (io.ReadCloser, error)
+}
+
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Platform  *struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+	} `json:"platform,omitempty"`
+}
+
+// ociManifest covers both image manifests and (nested) image indexes
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Config    ociDescriptor   `json:"config"`
+	Layers    []ociDescriptor `json:"layers"`
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+type dockerArchiveEntry struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+type imageConfig struct {
+	RootFS struct {
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+// loadImage reads the image manifest from a docker-save tarball or an OCI
+// layout directory and returns its layers bottom to top
+func loadImage(input string) (*ImageSource, []imageLayer, error) {
+	info, err := os.Stat(input)
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.IsDir() {
+		return loadOCILayout(input)
+	}
+	return loadDockerArchive(input)
+}
+
+func ociBlobPath(layout, digest string) (string, error) {
+	alg, hex, ok := strings.Cut(digest, ":")
+	if !ok || alg == "" || hex == "" || strings.ContainsAny(digest, `/\`) {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+	return filepath.Join(layout, "blobs", alg, hex), nil
+}
+
+func readJSONFile(file string, v interface{}) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// pickManifest prefers the entry for this architecture and skips the
+// unknown/unknown attestation manifests buildx adds to indexes
+func pickManifest(descs []ociDescriptor) (ociDescriptor, error) {
+	var candidates []ociDescriptor
+	for _, desc := range descs {
+		if desc.Platform != nil && desc.Platform.OS == "unknown" {
+			continue
+		}
+		candidates = append(candidates, desc)
+	}
+	if len(candidates) == 0 {
+		return ociDescriptor{}, fmt.Errorf("image index lists no manifests")
+	}
+	for _, desc := range candidates {
+		if desc.Platform != nil && desc.Platform.OS == "linux" && desc.Platform.Architecture == runtime.GOARCH {
+			return desc, nil
+		}
+	}
+	return candidates[0], nil
+}
+
+func loadOCILayout(layout string) (*ImageSource, []imageLayer, error) {
+	var index ociManifest
+	if err := readJSONFile(filepath.Join(layout, "index.json"), &index); err != nil {
+		return nil, nil, fmt.Errorf("failed to read OCI index: %w", err)
+	}
+
+	// Follow nested indexes down to a single image manifest
+	manifest := index
+	for depth := 0; len(manifest.Manifests) > 0; depth++ {
+		if depth >= 4 {
+			return nil, nil, fmt.Errorf("OCI index nesting too deep")
+		}
+		desc, err := pickManifest(manifest.Manifests)
+		if err != nil {
+			return nil, nil, err
+		}
+		blob, err := ociBlobPath(layout, desc.Digest)
+		if err != nil {
+			return nil, nil, err
+		}
+		manifest = ociManifest{}
+		if err := readJSONFile(blob, &manifest); err != nil {
+			return nil, nil, fmt.Errorf("failed to read manifest %s: %w", desc.Digest, err)
+		}
+	}
+
+	configBlob, err := ociBlobPath(layout, manifest.Config.Digest)
+	if err != nil {
+		return nil, nil, err
+	}
+	var config imageConfig
+	if err := readJSONFile(configBlob, &config); err != nil {
+		return nil, nil, fmt.Errorf("failed to read image config: %w", err)
+	}
+	diffIDs, err := layerDiffIDs(config, len(manifest.Layers))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	source := &ImageSource{Input: layout, Format: "oci-layout", Config: manifest.Config.Digest}
+	layers := make([]imageLayer, 0, len(manifest.Layers))
+	for i, desc := range manifest.Layers {
+		blob, err := ociBlobPath(layout, desc.Digest)
+		if err != nil {
+			return nil, nil, err
+		}
+		source.Layers = append(source.Layers, diffIDs[i])
+		layers = append(layers, imageLayer{
+			digest: diffIDs[i],
+			open:   func() (io.ReadCloser, error) { return os.Open(blob) },
+		})
+	}
+	return source, layers, nil
+}
+
+// openArchiveMember streams a single member of the outer docker-save tar
+func openArchiveMember(archive, name string) (io.ReadCloser, error) {
+	file, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+
+	want := path.Clean(name)
+	tr := tar.NewReader(file)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			file.Close()
+			return nil, fmt.Errorf("%s not found in archive", name)
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		if path.Clean(strings.TrimPrefix(hdr.Name, "./")) == want {
+			return struct {
+				io.Reader
+				io.Closer
+			}{tr, file}, nil
+		}
+	}
+}
+
+func readArchiveJSON(archive, name string, v interface{}) error {
+	member, err := openArchiveMember(archive, name)
+	if err != nil {
+		return err
+	}
+	defer member.Close()
+	return json.NewDecoder(member).Decode(v)
+}
+
+func loadDockerArchive(archive string) (*ImageSource, []imageLayer, error) {
+	var entries []dockerArchiveEntry
+	if err := readArchiveJSON(archive, "manifest.json", &entries); err != nil {
+		return nil, nil, fmt.Errorf("failed to read docker archive manifest: %w", err)
+	}
+	if len(entries) == 0 {
+		return nil, nil, fmt.Errorf("docker archive manifest lists no images")
+	}
+	if len(entries) > 1 {
+		fmt.Printf("⚠️  Archive contains %d images, scanning the first (%v)\n", len(entries), entries[0].RepoTags)
+	}
+	entry := entries[0]
+
+	// Layer members are named by path; the config's diff_ids are the digests
+	// docker itself reports for them
+	var config imageConfig
+	if err := readArchiveJSON(archive, entry.Config, &config); err != nil {
+		return nil, nil, fmt.Errorf("failed to read image config: %w", err)
+	}
+	diffIDs, err := layerDiffIDs(config, len(entry.Layers))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	configDigest := entry.Config
+	if hex := strings.TrimPrefix(entry.Config, "blobs/sha256/"); hex != entry.Config {
+		configDigest = "sha256:" + hex
+	} else if hex := strings.TrimSuffix(entry.Config, ".json"); hex != entry.Config {
+		configDigest = "sha256:" + hex
+	}
+
+	source := &ImageSource{Input: archive, Format: "docker-archive", Config: configDigest, RepoTags: entry.RepoTags}
+	layers := make([]imageLayer, 0, len(entry.Layers))
+	for i, member := range entry.Layers {
+		member := member
+		source.Layers = append(source.Layers, diffIDs[i])
+		layers = append(layers, imageLayer{
+			digest: diffIDs[i],
+			open:   func() (io.ReadCloser, error) { return openArchiveMember(archive, member) },
+		})
+	}
+	return source, layers, nil
+}
+
+// layerDiffIDs returns the uncompressed layer digests from the image
+// config. Both input formats carry them, so a layer is named the same
+// whichever way the image was exported.
+func layerDiffIDs(config imageConfig, layers int) ([]string, error) {
+	diffIDs := config.RootFS.DiffIDs
+	if len(diffIDs) != layers {
+		return nil, fmt.Errorf("image config lists %d diff_ids for %d layers", len(diffIDs), layers)
+	}
+	for _, id := range diffIDs {
+		if alg, hex, ok := strings.Cut(id, ":"); !ok || alg == "" || hex == "" {
+			return nil, fmt.Errorf("invalid diff_id %q in image config", id)
+		}
+	}
+	return diffIDs, nil
+}
+
+// decompressLayer sniffs the layer blob, which is gzip in most OCI layouts
+// and a plain tar in docker-save archives
+func decompressLayer(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return nil, fmt.Errorf("zstd-compressed layers are not supported")
+	default:
+		return br, nil
+	}
+}
+
+type mergedEntry struct {
+	info  FileInfo
+	mtime time.Time
+}
+
+// imageMerge is the merged filesystem built by applying layers in order
+type imageMerge struct {
+	files   map[string]*mergedEntry
+	deleted map[string]DeletedFile
+}
+
+func cleanLayerPath(name string) string {
+	name = path.Clean("/" + name)
+	return strings.TrimPrefix(name, "/")
+}
+
+// underAny reports whether an ancestor directory of p is in dirs
+func underAny(p string, dirs map[string]bool) bool {
+	for i := strings.LastIndexByte(p, '/'); i > 0; i = strings.LastIndexByte(p[:i], '/') {
+		if dirs[p[:i]] {
+			return true
+		}
+	}
+	return false
+}
+
+func sortDeleted(deleted []DeletedFile) {
+	sort.Slice(deleted, func(i, j int) bool { return deleted[i].Path < deleted[j].Path })
+}
+
+// applyLayer reads one layer and merges it over the lower layers. Whiteouts
+// only hide lower content, and tar order inside a layer is arbitrary, so the
+// whole layer is read before anything below it is changed.
+func (m *imageMerge) applyLayer(digest string, r io.Reader, opts *scanOptions, progress *ProgressTracker) ([]FailedFile, error) {
+	upper := make(map[string]*mergedEntry)
+	var links []*tar.Header
+	var failed []FailedFile
+
+	whiteouts := make(map[string]bool) // removed along with their children
+	opaque := make(map[string]bool)    // children removed, directory kept
+	shadowed := make(map[string]bool)  // replaced by a non-directory in this layer
+	var dirs []string
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return failed, fmt.Errorf("failed to read layer %s: %w", digest, err)
+		}
+
+		name := cleanLayerPath(hdr.Name)
+		if name == "" {
+			continue
+		}
+		dir, base := path.Split(name)
+		dir = strings.TrimSuffix(dir, "/")
+
+		switch {
+		case base == ".wh..wh..opq":
+			opaque[dir] = true
+			continue
+		case strings.HasPrefix(base, ".wh."):
+			whiteouts[path.Join(dir, strings.TrimPrefix(base, ".wh."))] = true
+			continue
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			dirs = append(dirs, name)
+		case tar.TypeReg:
+			// Layer attribution compares content, so it hashes even when
+			// sha256 itself is not emitted
+			var hash string
+			if opts.compute.Has(fieldSHA256) || opts.compute.Has(fieldLayer) {
+				if opts.dryRun {
+					hash = "dry-run-hash"
+				} else if hash, err = hashReader(tr); err != nil {
+					return failed, fmt.Errorf("failed to hash %s in layer %s: %w", name, digest, err)
+				}
+			}
+			upper[name] = &mergedEntry{
+				info: FileInfo{
+					Path:        name,
+					Size:        hdr.Size,
+					Mtime:       hdr.ModTime.UTC().Format(time.RFC3339),
+					SHA256:      hash,
+					Layer:       digest,
+					Permissions: hdr.FileInfo().Mode().String(),
+				},
+				mtime: hdr.ModTime,
+			}
+			shadowed[name] = true
+			progress.Update(1, 0, hdr.Size)
+		case tar.TypeLink:
+			links = append(links, hdr)
+			shadowed[name] = true
+		case tar.TypeSymlink:
+			// Hashed over the target, as for git symlinks
+			var hash string
+			if opts.compute.Has(fieldSHA256) || opts.compute.Has(fieldLayer) {
+				if opts.dryRun {
+					hash = "dry-run-hash"
+				} else if hash, err = hashReader(strings.NewReader(hdr.Linkname)); err != nil {
+					return failed, err
+				}
+			}
+			upper[name] = &mergedEntry{
+				info: FileInfo{
+					Path:        name,
+					Mtime:       hdr.ModTime.UTC().Format(time.RFC3339),
+					SHA256:      hash,
+					Layer:       digest,
+					Type:        "symlink",
+					Permissions: hdr.FileInfo().Mode().String(),
+					Target:      hdr.Linkname,
+				},
+				mtime: hdr.ModTime,
+			}
+			shadowed[name] = true
+			progress.Update(1, 0, 0)
+		default:
+			// Devices and fifos carry no content but still replace
+			// whatever the lower layers had at that path
+			shadowed[name] = true
+		}
+	}
+
+	// Hard links share their target's content, which normally sits earlier
+	// in the same layer
+	for _, hdr := range links {
+		name := cleanLayerPath(hdr.Name)
+		target := cleanLayerPath(hdr.Linkname)
+		src, ok := upper[target]
+		if !ok {
+			src, ok = m.files[target]
+		}
+		if !ok {
+			failed = append(failed, FailedFile{Path: name, Reason: fmt.Sprintf("hard link target %s not found in layer %s", target, digest)})
+			continue
+		}
+		entry := *src
+		entry.info.Path = name
+		entry.info.Layer = digest
+		upper[name] = &entry
+	}
+
+	rootOpaque := opaque[""]
+	for p, entry := range m.files {
+		if rootOpaque || whiteouts[p] || underAny(p, whiteouts) || underAny(p, opaque) {
+			m.deleted[p] = DeletedFile{Path: p, DeletedBy: digest, IntroducedBy: entry.info.Layer}
+			delete(m.files, p)
+			continue
+		}
+
+		// Overwritten rather than deleted: a lower directory replaced by a
+		// file or link, or a lower file replaced by a link or device.
+		// Regular files are swapped in below.
+		if _, replaced := upper[p]; !replaced && (shadowed[p] || underAny(p, shadowed)) {
+			delete(m.files, p)
+		}
+	}
+
+	// A directory in this layer replaces a lower file of the same name
+	for _, dir := range dirs {
+		delete(m.files, dir)
+	}
+
+	for p, entry := range upper {
+		// Rewriting identical bytes (e.g. a chmod copy-up) does not change
+		// which layer introduced the content. Under -dry-run nothing is
+		// hashed, so the last layer to write a path is credited instead.
+		if lower, ok := m.files[p]; ok && !opts.dryRun && entry.info.SHA256 != "" && lower.info.SHA256 == entry.info.SHA256 {
+			entry.info.Layer = lower.info.Layer
+		}
+		m.files[p] = entry
+		delete(m.deleted, p)
+	}
+	return failed, nil
+}
+
+// scanImage builds the manifest of an image's final merged filesystem,
+// hashing each file straight from its layer tar stream
+func scanImage(input string, opts scanOptions, listDeleted bool, phases *phaseTimer) (*scanResult, *ImageSource, error) {
+	stopDiscovery := phases.Start("discovery")
+	source, layers, err := loadImage(input)
+	stopDiscovery()
+	if err != nil {
+		return nil, nil, err
+	}
+	fmt.Printf("📊 Found %d layers to process\n", len(layers))
+
+	progress := NewProgressTracker()
+	stopProcessing := phases.Start("processing")
+	merge := &imageMerge{
+		files:   make(map[string]*mergedEntry),
+		deleted: make(map[string]DeletedFile),
+	}
+
+	var failed []FailedFile
+	for _, layer := range layers {
+		blob, err := layer.open()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open layer %s: %w", layer.digest, err)
+		}
+		r, err := decompressLayer(blob)
+		if err != nil {
+			blob.Close()
+			return nil, nil, fmt.Errorf("failed to read layer %s: %w", layer.digest, err)
+		}
+		layerFailed, err := merge.applyLayer(layer.digest, r, &opts, progress)
+		blob.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		failed = append(failed, layerFailed...)
+	}
+
+	result := &scanResult{failed: failed, files: make([]FileInfo, 0, len(merge.files))}
+	for _, entry := range merge.files {
+		opts.annotate(&entry.info, entry.mtime)
+		result.files = append(result.files, entry.info)
+		result.totalSize += entry.info.Size
+	}
+	if listDeleted {
+		for _, deleted := range merge.deleted {
+			result.deleted = append(result.deleted, deleted)
+		}
+		sortDeleted(result.deleted)
+	}
+	stopProcessing()
+
+	// Clear progress line
+	fmt.Print("\r" + strings.Repeat(" ", 100) + "\r")
+
+	result.processed = int64(len(result.files))
+	result.failedCount = int64(len(failed))
+	result.total = result.processed + result.failedCount
+	_, _, _, result.elapsed = progress.FinalStats()
+	return result, source, nil
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type tarMember struct {
+	name    string
+	content string
+	dir     bool
+	link    string // symlink target
+}
+
+func buildLayer(t *testing.T, members []tarMember) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	mtime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, m := range members {
+		hdr := &tar.Header{Name: m.name, Mode: 0644, Size: int64(len(m.content)), ModTime: mtime, Typeflag: tar.TypeReg}
+		switch {
+		case m.dir:
+			hdr.Typeflag, hdr.Mode, hdr.Size = tar.TypeDir, 0755, 0
+		case m.link != "":
+			hdr.Typeflag, hdr.Mode, hdr.Size, hdr.Linkname = tar.TypeSymlink, 0777, 0, m.link
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(m.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func sha256Digest(data []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+}
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// fixtureLayers overwrites etc/config in the top layer, rewrites keep/a
+// unchanged, whites out a file and a directory, makes opq opaque and links
+// bin to usr/bin
+func fixtureLayers(t *testing.T) [][]byte {
+	lower := buildLayer(t, []tarMember{
+		{name: "etc/", dir: true},
+		{name: "etc/config", content: "v1"},
+		{name: "keep/a", content: "kept"},
+		{name: "gone/x", content: "x"},
+		{name: "gone/y", content: "y"},
+		{name: "opq/old", content: "old"},
+		{name: "rm.txt", content: "rm"},
+		{name: "usr/bin/sh", content: "#!"},
+	})
+	upper := buildLayer(t, []tarMember{
+		{name: "etc/config", content: "v2"},
+		{name: "keep/a", content: "kept"},
+		{name: ".wh.gone"},
+		{name: "opq/.wh..wh..opq"},
+		{name: "opq/new", content: "new"},
+		{name: ".wh.rm.txt"},
+		{name: "bin", link: "usr/bin"},
+	})
+	return [][]byte{lower, upper}
+}
+
+func writeBlob(t *testing.T, layout string, data []byte) string {
+	t.Helper()
+	digest := sha256Digest(data)
+	blob, err := ociBlobPath(layout, digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(blob), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(blob, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return digest
+}
+
+func mustJSON(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// fixtureConfig is the image config naming layers by their diff_ids
+func fixtureConfig(layers [][]byte) (imageConfig, []string) {
+	var diffIDs []string
+	for _, layer := range layers {
+		diffIDs = append(diffIDs, sha256Digest(layer))
+	}
+	var config imageConfig
+	config.RootFS.DiffIDs = diffIDs
+	return config, diffIDs
+}
+
+// writeOCILayout stores the lower layer gzipped and the upper one plain, and
+// returns the diff_ids that scanImage reports as layer digests, which for
+// the gzipped layer differ from its blob digest
+func writeOCILayout(t *testing.T, layers [][]byte) (string, []string) {
+	config, diffIDs := fixtureConfig(layers)
+	return writeOCILayoutConfig(t, layers, config), diffIDs
+}
+
+func writeOCILayoutConfig(t *testing.T, layers [][]byte, config imageConfig) string {
+	layout := t.TempDir()
+	manifest := ociManifest{
+		MediaType: "application/vnd.oci.image.manifest.v1+json",
+		Config:    ociDescriptor{Digest: writeBlob(t, layout, mustJSON(t, config))},
+	}
+	for i, layer := range layers {
+		if i == 0 {
+			layer = gzipBytes(t, layer)
+		}
+		manifest.Layers = append(manifest.Layers, ociDescriptor{Digest: writeBlob(t, layout, layer)})
+	}
+	manifestDigest := writeBlob(t, layout, mustJSON(t, manifest))
+
+	index := ociManifest{Manifests: []ociDescriptor{{Digest: manifestDigest}}}
+	if err := os.WriteFile(filepath.Join(layout, "index.json"), mustJSON(t, index), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return layout
+}
+
+// writeDockerArchive returns the tarball path and the config's diff_ids,
+// which scanImage reports as the layer digests
+func writeDockerArchive(t *testing.T, layers [][]byte) (string, []string) {
+	config, diffIDs := fixtureConfig(layers)
+
+	archive := filepath.Join(t.TempDir(), "image.tar")
+	file, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	tw := tar.NewWriter(file)
+	members := []struct {
+		name string
+		data []byte
+	}{
+		{"manifest.json", mustJSON(t, []dockerArchiveEntry{{
+			Config:   "config.json",
+			RepoTags: []string{"fixture:latest"},
+			Layers:   []string{"lower/layer.tar", "upper/layer.tar"},
+		}})},
+		{"config.json", mustJSON(t, config)},
+		{"lower/layer.tar", layers[0]},
+		{"upper/layer.tar", layers[1]},
+	}
+	for _, m := range members {
+		if err := tw.WriteHeader(&tar.Header{Name: m.name, Mode: 0644, Size: int64(len(m.data))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(m.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return archive, diffIDs
+}
+
+func TestScanImage(t *testing.T) {
+	layers := fixtureLayers(t)
+	cases := []struct {
+		name  string
+		write func(*testing.T, [][]byte) (string, []string)
+	}{
+		{"oci-layout", writeOCILayout},
+		{"docker-archive", writeDockerArchive},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			input, digests := tc.write(t, layers)
+			lower, upper := digests[0], digests[1]
+
+			opts := scanOptions{compute: allFileFields}
+			scan, source, err := scanImage(input, opts, true, &phaseTimer{})
+			if err != nil {
+				t.Fatalf("scanImage: %v", err)
+			}
+			if source.Format != tc.name {
+				t.Errorf("format = %q, want %q", source.Format, tc.name)
+			}
+			if !reflect.DeepEqual(source.Layers, digests) {
+				t.Errorf("layers = %v, want %v", source.Layers, digests)
+			}
+
+			files := make(map[string]FileInfo)
+			for _, f := range scan.files {
+				files[f.Path] = f
+			}
+			// Symlinks hash their target
+			want := map[string]struct{ content, layer string }{
+				"etc/config": {"v2", upper},
+				"keep/a":     {"kept", lower},
+				"opq/new":    {"new", upper},
+				"usr/bin/sh": {"#!", lower},
+				"bin":        {"usr/bin", upper},
+			}
+			if len(files) != len(want) {
+				t.Errorf("got files %v, want %d entries", reflect.ValueOf(files).MapKeys(), len(want))
+			}
+			for p, w := range want {
+				f, ok := files[p]
+				if !ok {
+					t.Errorf("%s missing from merged filesystem", p)
+					continue
+				}
+				if hash := fmt.Sprintf("%x", sha256.Sum256([]byte(w.content))); f.SHA256 != hash {
+					t.Errorf("%s sha256 = %s, want hash of %q", p, f.SHA256, w.content)
+				}
+				if f.Layer != w.layer {
+					t.Errorf("%s layer = %s, want %s", p, f.Layer, w.layer)
+				}
+			}
+			if link := files["bin"]; link.Type != "symlink" || link.Target != "usr/bin" {
+				t.Errorf("bin = type %q target %q, want symlink to usr/bin", link.Type, link.Target)
+			}
+
+			wantDeleted := []DeletedFile{
+				{Path: "gone/x", DeletedBy: upper, IntroducedBy: lower},
+				{Path: "gone/y", DeletedBy: upper, IntroducedBy: lower},
+				{Path: "opq/old", DeletedBy: upper, IntroducedBy: lower},
+				{Path: "rm.txt", DeletedBy: upper, IntroducedBy: lower},
+			}
+			if !reflect.DeepEqual(scan.deleted, wantDeleted) {
+				t.Errorf("deleted = %+v, want %+v", scan.deleted, wantDeleted)
+			}
+
+			// Without -oci-list-deleted the deletions are not reported, and
+			// dropping sha256 from -fields must not change attribution
+			opts.compute = allFileFields &^ fieldSHA256
+			scan, _, err = scanImage(input, opts, false, &phaseTimer{})
+			if err != nil {
+				t.Fatalf("scanImage: %v", err)
+			}
+			if len(scan.deleted) != 0 {
+				t.Errorf("deleted files listed without -oci-list-deleted: %+v", scan.deleted)
+			}
+			for _, f := range scan.files {
+				if f.Layer != want[f.Path].layer {
+					t.Errorf("without sha256 %s layer = %s, want %s", f.Path, f.Layer, want[f.Path].layer)
+				}
+			}
+		})
+	}
+}
+
+func TestScanImageRejectsMismatchedDiffIDs(t *testing.T) {
+	layers := fixtureLayers(t)
+	config, _ := fixtureConfig(layers[:1])
+	layout := writeOCILayoutConfig(t, layers, config)
+	if _, _, err := scanImage(layout, scanOptions{compute: allFileFields}, false, &phaseTimer{}); err == nil {
+		t.Fatal("scanImage accepted a config whose diff_ids do not match its layers")
+	}
+}
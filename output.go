@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultOutputTemplate = "manifest-{date}"
+	failedManifestSuffix  = ".failed"
+)
+
+// labelFlag collects repeatable -label key=value pairs
+type labelFlag map[string]string
+
+func (lf labelFlag) String() string {
+	pairs := make([]string, 0, len(lf))
+	for k, v := range lf {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (lf labelFlag) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("label must be key=value, got %q", value)
+	}
+	lf[key] = val
+	return nil
+}
+
+// outputTemplate names timestamped manifests inside an output directory and
+// recognises the ones it produced so retention never touches foreign files.
+type outputTemplate struct {
+	dir      string
+	template string
+	ext      string
+	hostname string
+	labels   map[string]string
+	pattern  *regexp.Regexp
+}
+
+var templateFieldRe = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// Colons are not allowed in Windows file names, so the timestamp uses dashes there
+func manifestTimeLayout() string {
+	if runtime.GOOS == "windows" {
+		return "2006-01-02T15-04-05Z"
+	}
+	return time.RFC3339
+}
+
+func manifestTimePattern() string {
+	if runtime.GOOS == "windows" {
+		return `\d{4}-\d{2}-\d{2}T\d{2}-\d{2}-\d{2}Z`
+	}
+	return `\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}Z`
+}
+
+// sanitizeNameComponent keeps template values from escaping the output
+// directory or producing awkward file names
+func sanitizeNameComponent(value string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '-' || r == '_' || r == '.':
+			return r
+		default:
+			return '_'
+		}
+	}, value)
+}
+
+func newOutputTemplate(dir, template string, compress bool, labels map[string]string) (*outputTemplate, error) {
+	if strings.ContainsAny(template, `/\`) {
+		return nil, fmt.Errorf("output template must not contain path separators: %q", template)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "unknown"
+	}
+
+	ot := &outputTemplate{
+		dir:      dir,
+		template: template,
+		ext:      ".json",
+		hostname: sanitizeNameComponent(hostname),
+		labels:   labels,
+	}
+	if compress {
+		ot.ext = ".json.gz"
+	}
+
+	// Build the matching pattern alongside validation: every field except
+	// {date} renders to a fixed value for this invocation, so it is matched
+	// literally and only the timestamp varies between runs.
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	dateCount := 0
+	last := 0
+	for _, loc := range templateFieldRe.FindAllStringSubmatchIndex(template, -1) {
+		pattern.WriteString(regexp.QuoteMeta(template[last:loc[0]]))
+		last = loc[1]
+
+		field := template[loc[2]:loc[3]]
+		switch {
+		case field == "date":
+			dateCount++
+			pattern.WriteString("(" + manifestTimePattern() + ")")
+		case field == "hostname":
+			pattern.WriteString(regexp.QuoteMeta(ot.hostname))
+		case strings.HasPrefix(field, "label:"):
+			name := strings.TrimPrefix(field, "label:")
+			value, ok := labels[name]
+			if !ok {
+				return nil, fmt.Errorf("output template references undefined label %q", name)
+			}
+			pattern.WriteString(regexp.QuoteMeta(sanitizeNameComponent(value)))
+		default:
+			return nil, fmt.Errorf("unknown output template field {%s} (valid: {date}, {hostname}, {label:NAME})", field)
+		}
+	}
+	pattern.WriteString(regexp.QuoteMeta(template[last:]))
+	pattern.WriteString(regexp.QuoteMeta(ot.ext) + "$")
+
+	if dateCount != 1 {
+		return nil, fmt.Errorf("output template must contain {date} exactly once: %q", template)
+	}
+
+	ot.pattern, err = regexp.Compile(pattern.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile output template: %w", err)
+	}
+	return ot, nil
+}
+
+// Path returns the manifest path for a run started at ts
+func (ot *outputTemplate) Path(ts time.Time) string {
+	name := templateFieldRe.ReplaceAllStringFunc(ot.template, func(token string) string {
+		field := token[1 : len(token)-1]
+		switch {
+		case field == "date":
+			return ts.UTC().Format(manifestTimeLayout())
+		case field == "hostname":
+			return ot.hostname
+		default:
+			return sanitizeNameComponent(ot.labels[strings.TrimPrefix(field, "label:")])
+		}
+	})
+	return filepath.Join(ot.dir, name+ot.ext)
+}
+
+// FailedPath is where a run below the success threshold writes. The suffix
+// keeps it out of the template pattern, so list never counts it.
+func (ot *outputTemplate) FailedPath(ts time.Time) string {
+	return ot.Path(ts) + failedManifestSuffix
+}
+
+// LatestPath is the stable name pointing at the newest manifest
+func (ot *outputTemplate) LatestPath() string {
+	return filepath.Join(ot.dir, "latest"+ot.ext)
+}
+
+type datedManifest struct {
+	name string
+	ts   time.Time
+}
+
+// list returns the manifests in the directory that match the template,
+// oldest first by the timestamp encoded in the name (not mtime).
+func (ot *outputTemplate) list() ([]datedManifest, error) {
+	entries, err := os.ReadDir(ot.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifests []datedManifest
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		m := ot.pattern.FindStringSubmatch(entry.Name())
+		if m == nil {
+			continue
+		}
+		ts, err := time.Parse(manifestTimeLayout(), m[1])
+		if err != nil {
+			continue
+		}
+		manifests = append(manifests, datedManifest{name: entry.Name(), ts: ts})
+	}
+
+	sort.Slice(manifests, func(i, j int) bool {
+		if !manifests[i].ts.Equal(manifests[j].ts) {
+			return manifests[i].ts.Before(manifests[j].ts)
+		}
+		return manifests[i].name < manifests[j].name
+	})
+	return manifests, nil
+}
+
+// Rotate points "latest" at the newest manifest and, when keepLast > 0,
+// deletes the oldest matching manifests beyond that count. It must only be
+// called after a successful write.
+func (ot *outputTemplate) Rotate(keepLast int) error {
+	manifests, err := ot.list()
+	if err != nil {
+		return fmt.Errorf("failed to list output directory: %w", err)
+	}
+	if len(manifests) == 0 {
+		return nil
+	}
+
+	if err := ot.updateLatest(manifests[len(manifests)-1].name); err != nil {
+		return fmt.Errorf("failed to update latest manifest: %w", err)
+	}
+
+	if keepLast <= 0 || len(manifests) <= keepLast {
+		return nil
+	}
+	for _, m := range manifests[:len(manifests)-keepLast] {
+		if err := os.Remove(filepath.Join(ot.dir, m.name)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove old manifest %s: %w", m.name, err)
+		}
+		fmt.Printf("🧹 Removed old manifest: %s\n", m.name)
+	}
+	return nil
+}
+
+// updateLatest replaces the latest pointer atomically: a relative symlink
+// where supported, a copy on Windows.
+func (ot *outputTemplate) updateLatest(name string) error {
+	latest := ot.LatestPath()
+	tmp := latest + ".tmp"
+	os.Remove(tmp)
+
+	if runtime.GOOS == "windows" {
+		if err := copyFile(filepath.Join(ot.dir, name), tmp); err != nil {
+			return err
+		}
+	} else if err := os.Symlink(name, tmp); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, latest); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+// encodeManifest writes the manifest as indented JSON. Files, which can
+// run to millions of entries, are streamed one at a time; only the small
+// remainder of the manifest is marshalled in one piece.
+func encodeManifest(w io.Writer, manifest *ManifestResult) error {
+	// The outer Files shadows the embedded one and is always omitted
+	type plainManifest ManifestResult
+	rest, err := json.MarshalIndent(struct {
+		Files []FileInfo `json:"files,omitempty"`
+		*plainManifest
+	}{plainManifest: (*plainManifest)(manifest)}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriterSize(w, 256*1024)
+	bw.WriteString("{\n  \"files\": ")
+	switch {
+	case manifest.Files == nil:
+		bw.WriteString("null")
+	case len(manifest.Files) == 0:
+		bw.WriteString("[]")
+	default:
+		var entry, indented bytes.Buffer
+		bw.WriteByte('[')
+		for i := range manifest.Files {
+			entry.Reset()
+			indented.Reset()
+			if err := encodeFileEntry(&entry, &manifest.Files[i], manifest.fields); err != nil {
+				return err
+			}
+			if err := json.Indent(&indented, entry.Bytes(), "    ", "  "); err != nil {
+				return err
+			}
+			if i > 0 {
+				bw.WriteByte(',')
+			}
+			bw.WriteString("\n    ")
+			bw.Write(indented.Bytes())
+		}
+		bw.WriteString("\n  ]")
+	}
+
+	// rest opens with "{\n"; its fields follow the files array
+	bw.WriteByte(',')
+	bw.Write(rest[1:])
+	bw.WriteByte('\n')
+	return bw.Flush()
+}
+
+// writeManifestFile writes to a temporary file next to path and renames it
+// into place, so an interrupted run never leaves a truncated manifest that
+// retention would count as good.
+func writeManifestFile(path string, compress bool, manifest *ManifestResult) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("output file already exists: %s", path)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".manifest-*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary output file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	var output io.Writer = tmp
+	var gzWriter *gzip.Writer
+	if compress {
+		gzWriter = gzip.NewWriter(tmp)
+		output = gzWriter
+	}
+
+	if err := encodeManifest(output, manifest); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to encode JSON: %w", err)
+	}
+	if gzWriter != nil {
+		if err := gzWriter.Close(); err != nil {
+			tmp.Close()
+			return fmt.Errorf("failed to finish compression: %w", err)
+		}
+	}
+	// CreateTemp uses 0600; match what os.Create would have produced
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to set output file mode: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close output file: %w", err)
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// readManifest loads a previously written manifest, gzipped or not
+func readManifest(path string) (*ManifestResult, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r, err := decompressMaybe(file)
+	if err != nil {
+		return nil, err
+	}
+	var manifest ManifestResult
+	if err := json.NewDecoder(r).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest %s: %w", path, err)
+	}
+	return &manifest, nil
+}
+
+func decompressMaybe(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+	return br, nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"testing"
+	"time"
+)
+
+var rotateBase = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// rotateFixture writes n manifests an hour apart whose mtimes run the other
+// way, plus files retention must never touch. It returns the manifest
+// names oldest first and the foreign names.
+func rotateFixture(t *testing.T, n int) (*outputTemplate, []string, []string) {
+	t.Helper()
+	dir := t.TempDir()
+	labels := map[string]string{"env": "prod"}
+	ot, err := newOutputTemplate(dir, "manifest-{hostname}-{label:env}-{date}", false, labels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := newOutputTemplate(dir, "manifest-{hostname}-{label:env}-{date}", false, map[string]string{"env": "staging"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz, err := newOutputTemplate(dir, "manifest-{hostname}-{label:env}-{date}", true, labels)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	touch := func(path string, mtime time.Time) {
+		if err := os.WriteFile(path, []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var names []string
+	for i := 0; i < n; i++ {
+		ts := rotateBase.Add(time.Duration(i) * time.Hour)
+		path := ot.Path(ts)
+		touch(path, rotateBase.Add(-time.Duration(i)*time.Hour))
+		names = append(names, filepath.Base(path))
+	}
+
+	old := rotateBase.Add(-24 * time.Hour)
+	foreign := []string{
+		filepath.Base(other.Path(old)),
+		filepath.Base(gz.Path(old)),
+		filepath.Base(ot.FailedPath(rotateBase.Add(48 * time.Hour))),
+		filepath.Base(ot.FailedPath(old)),
+		"manifest-" + ot.hostname + "-prod-not-a-date.json",
+		"notes.txt",
+	}
+	// Another host writing into the same directory
+	foreign = append(foreign, "manifest-otherhost-prod-"+old.Format(manifestTimeLayout())+".json")
+	for _, name := range foreign {
+		touch(filepath.Join(dir, name), old)
+	}
+	return ot, names, foreign
+}
+
+func dirNames(t *testing.T, dir string) map[string]bool {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]bool)
+	for _, entry := range entries {
+		names[entry.Name()] = true
+	}
+	return names
+}
+
+func TestOutputTemplateListOrdersByEncodedTime(t *testing.T) {
+	ot, names, _ := rotateFixture(t, 4)
+	manifests, err := ot.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, m := range manifests {
+		got = append(got, m.name)
+	}
+	if len(got) != len(names) {
+		t.Fatalf("list = %v, want %v", got, names)
+	}
+	for i := range names {
+		if got[i] != names[i] {
+			t.Fatalf("list = %v, want %v (mtimes must not decide the order)", got, names)
+		}
+	}
+}
+
+func TestOutputTemplateRotate(t *testing.T) {
+	cases := []struct {
+		keepLast int
+		kept     int
+	}{
+		{keepLast: 0, kept: 4},
+		{keepLast: 5, kept: 4},
+		{keepLast: 4, kept: 4},
+		{keepLast: 3, kept: 3},
+		{keepLast: 1, kept: 1},
+	}
+	for _, tc := range cases {
+		ot, names, foreign := rotateFixture(t, 4)
+		if err := ot.Rotate(tc.keepLast); err != nil {
+			t.Fatalf("keep-last %d: %v", tc.keepLast, err)
+		}
+
+		present := dirNames(t, ot.dir)
+		for i, name := range names {
+			want := i >= len(names)-tc.kept
+			if present[name] != want {
+				t.Errorf("keep-last %d: %s present = %v, want %v", tc.keepLast, name, present[name], want)
+			}
+		}
+		for _, name := range foreign {
+			if !present[name] {
+				t.Errorf("keep-last %d: removed foreign file %s", tc.keepLast, name)
+			}
+		}
+
+		// latest follows the newest good manifest, never a .failed one
+		newest := names[len(names)-1]
+		if runtime.GOOS == "windows" {
+			if !present[filepath.Base(ot.LatestPath())] {
+				t.Errorf("keep-last %d: latest copy missing", tc.keepLast)
+			}
+			continue
+		}
+		target, err := os.Readlink(ot.LatestPath())
+		if err != nil {
+			t.Fatalf("keep-last %d: %v", tc.keepLast, err)
+		}
+		if target != newest {
+			t.Errorf("keep-last %d: latest -> %s, want %s", tc.keepLast, target, newest)
+		}
+	}
+}
+
+func TestOutputTemplateFailedPathUnmatched(t *testing.T) {
+	ot, err := newOutputTemplate(t.TempDir(), defaultOutputTemplate, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := filepath.Base(ot.Path(rotateBase)); !ot.pattern.MatchString(name) {
+		t.Errorf("pattern does not match its own manifest %s", name)
+	}
+	if name := filepath.Base(ot.FailedPath(rotateBase)); ot.pattern.MatchString(name) {
+		t.Errorf("pattern matches failed manifest %s", name)
+	}
+
+	if err := os.WriteFile(ot.FailedPath(rotateBase), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ot.Rotate(1); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for name := range dirNames(t, ot.dir) {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) != 1 || names[0] != filepath.Base(ot.FailedPath(rotateBase)) {
+		t.Errorf("directory after rotate = %v, want only the failed manifest and no latest", names)
+	}
+}
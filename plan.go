@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPlanSample = 300
+	defaultPlanTop    = 10
+
+	// Probing reads at most this much of each sampled file and
+	// extrapolates, so one huge file cannot stall the plan
+	planProbeReadLimit = 64 * 1024 * 1024
+)
+
+// planSizeBuckets are the upper bounds used for the size breakdown and
+// for stratifying the hash probe
+var planSizeBuckets = []struct {
+	label string
+	max   int64
+}{
+	{"<4KiB", 4 << 10},
+	{"4KiB-64KiB", 64 << 10},
+	{"64KiB-1MiB", 1 << 20},
+	{"1MiB-16MiB", 16 << 20},
+	{"16MiB-256MiB", 256 << 20},
+	{"256MiB-4GiB", 4 << 30},
+	{">=4GiB", math.MaxInt64},
+}
+
+type PlanBucket struct {
+	Label string `json:"label"`
+	Files int64  `json:"files"`
+	Bytes int64  `json:"bytes"`
+
+	// Hash probe results for this bucket
+	SampledFiles int     `json:"sampled_files"`
+	SampledBytes int64   `json:"sampled_bytes"`
+	SampledMs    float64 `json:"sampled_ms"`
+	EstimatedMs  float64 `json:"estimated_ms"`
+}
+
+type PlanCount struct {
+	Files int64 `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+type PlanFile struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// PlanBaseline counts entries an earlier manifest already describes with
+// the same size and mtime
+type PlanBaseline struct {
+	Manifest       string `json:"manifest"`
+	Entries        int    `json:"entries"`
+	Unchanged      int64  `json:"unchanged"`
+	UnchangedBytes int64  `json:"unchanged_bytes"`
+}
+
+type PlanEstimate struct {
+	Duration   string  `json:"duration"`
+	Seconds    float64 `json:"seconds"`
+	Workers    int     `json:"workers"`
+	Assumption string  `json:"assumption"`
+}
+
+// PlanReport is what -plan prints and writes to -plan-out
+type PlanReport struct {
+	Root        string               `json:"root"`
+	GeneratedAt string               `json:"generated_at"`
+	TotalFiles  int64                `json:"total_files"`
+	TotalBytes  int64                `json:"total_bytes"`
+	Agents      map[string]PlanCount `json:"agents"`
+	SizeBuckets []PlanBucket         `json:"size_buckets"`
+	Largest     []PlanFile           `json:"largest"`
+	Baseline    *PlanBaseline        `json:"baseline,omitempty"`
+	Estimate    PlanEstimate         `json:"estimate"`
+}
+
+type planEntry struct {
+	absPath string
+	relPath string
+	size    int64
+	mtime   string
+}
+
+func planBucketIndex(size int64) int {
+	for i, bucket := range planSizeBuckets {
+		if size < bucket.max {
+			return i
+		}
+	}
+	return len(planSizeBuckets) - 1
+}
+
+// buildPlan walks and stats everything a real run would scan, then times a
+// stratified hash probe to project the full run's duration
+func buildPlan(root string, workers, sampleSize, top int, baselinePath string) (*PlanReport, error) {
+	var entries []planEntry
+	err := walkFiles(root, func(absPath string, info os.FileInfo) {
+		relPath, err := getRelativePath(root, absPath)
+		if err != nil {
+			return
+		}
+		entries = append(entries, planEntry{
+			absPath: absPath,
+			relPath: relPath,
+			size:    info.Size(),
+			mtime:   info.ModTime().UTC().Format(time.RFC3339),
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].relPath < entries[j].relPath })
+
+	report := &PlanReport{
+		Root:        root,
+		GeneratedAt: time.Now().UTC().Format(time.RFC3339),
+		Agents:      make(map[string]PlanCount),
+		SizeBuckets: make([]PlanBucket, len(planSizeBuckets)),
+	}
+	for i, bucket := range planSizeBuckets {
+		report.SizeBuckets[i].Label = bucket.label
+	}
+
+	byBucket := make([][]*planEntry, len(planSizeBuckets))
+	for i := range entries {
+		entry := &entries[i]
+		report.TotalFiles++
+		report.TotalBytes += entry.size
+
+		name := classifyAgent(entry.relPath)
+		agent := report.Agents[name]
+		agent.Files++
+		agent.Bytes += entry.size
+		report.Agents[name] = agent
+
+		b := planBucketIndex(entry.size)
+		report.SizeBuckets[b].Files++
+		report.SizeBuckets[b].Bytes += entry.size
+		byBucket[b] = append(byBucket[b], entry)
+	}
+
+	largest := make([]*planEntry, len(entries))
+	for i := range entries {
+		largest[i] = &entries[i]
+	}
+	sort.SliceStable(largest, func(i, j int) bool { return largest[i].size > largest[j].size })
+	if len(largest) > top {
+		largest = largest[:top]
+	}
+	for _, entry := range largest {
+		report.Largest = append(report.Largest, PlanFile{Path: entry.relPath, Size: entry.size})
+	}
+
+	if baselinePath != "" {
+		baseline, err := readManifest(baselinePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read baseline: %w", err)
+		}
+		report.Baseline = compareBaseline(baselinePath, baseline, entries)
+	}
+
+	probeBuckets(report, byBucket, sampleSize)
+
+	var sequential float64
+	for _, bucket := range report.SizeBuckets {
+		sequential += bucket.EstimatedMs
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	seconds := sequential / 1000 / float64(workers)
+	report.Estimate = PlanEstimate{
+		Duration:   roundPlanDuration(time.Duration(seconds * float64(time.Second))).String(),
+		Seconds:    math.Round(seconds*10) / 10,
+		Workers:    workers,
+		Assumption: "single-threaded probe throughput scaled linearly across workers; page cache and storage contention are not modelled",
+	}
+	return report, nil
+}
+
+// roundPlanDuration keeps sub-second estimates visible; ETA rounding
+// would report them all as 0s
+func roundPlanDuration(d time.Duration) time.Duration {
+	if d < time.Second {
+		return roundPhaseDuration(d)
+	}
+	return roundETA(d)
+}
+
+func compareBaseline(path string, baseline *ManifestResult, entries []planEntry) *PlanBaseline {
+	type key struct {
+		size  int64
+		mtime string
+	}
+	known := make(map[string]key, len(baseline.Files))
+	for _, f := range baseline.Files {
+		known[f.Path] = key{size: f.Size, mtime: f.Mtime}
+	}
+
+	result := &PlanBaseline{Manifest: path, Entries: len(baseline.Files)}
+	for _, entry := range entries {
+		if k, ok := known[entry.relPath]; ok && k.size == entry.size && k.mtime == entry.mtime {
+			result.Unchanged++
+			result.UnchangedBytes += entry.size
+		}
+	}
+	return result
+}
+
+// probeBuckets hashes an evenly spaced sample from each non-empty bucket
+// and extrapolates each bucket's cost from its measured time per byte
+func probeBuckets(report *PlanReport, byBucket [][]*planEntry, sampleSize int) {
+	nonEmpty := 0
+	for _, entries := range byBucket {
+		if len(entries) > 0 {
+			nonEmpty++
+		}
+	}
+	if nonEmpty == 0 || sampleSize <= 0 {
+		return
+	}
+	perBucket := sampleSize / nonEmpty
+	if perBucket < 1 {
+		perBucket = 1
+	}
+
+	for b, entries := range byBucket {
+		if len(entries) == 0 {
+			continue
+		}
+		bucket := &report.SizeBuckets[b]
+
+		n := perBucket
+		if n > len(entries) {
+			n = len(entries)
+		}
+		var elapsed time.Duration
+		var logicalBytes int64
+		for i := 0; i < n; i++ {
+			entry := entries[i*len(entries)/n]
+			read, took, err := probeHash(entry.absPath)
+			if err != nil {
+				continue
+			}
+			bucket.SampledFiles++
+			bucket.SampledBytes += read
+			logicalBytes += entry.size
+			elapsed += took
+		}
+		bucket.SampledMs = float64(elapsed.Microseconds()) / 1000
+		if bucket.SampledFiles == 0 {
+			continue
+		}
+
+		// Capped reads are scaled up to the files' full size. Time per byte
+		// then covers throughput; buckets of empty files fall back to time
+		// per file, which is pure open overhead.
+		sampledMs := bucket.SampledMs
+		if logicalBytes > bucket.SampledBytes && bucket.SampledBytes > 0 {
+			sampledMs *= float64(logicalBytes) / float64(bucket.SampledBytes)
+		}
+		if logicalBytes > 0 {
+			bucket.EstimatedMs = sampledMs / float64(logicalBytes) * float64(bucket.Bytes)
+		} else {
+			bucket.EstimatedMs = sampledMs / float64(bucket.SampledFiles) * float64(bucket.Files)
+		}
+		bucket.EstimatedMs = math.Round(bucket.EstimatedMs*1000) / 1000
+	}
+}
+
+func probeHash(path string) (int64, time.Duration, error) {
+	start := time.Now()
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	counter := &countingReader{r: io.LimitReader(file, planProbeReadLimit)}
+	if _, err := hashReader(counter); err != nil {
+		return 0, 0, err
+	}
+	return counter.n, time.Since(start), nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+func (report *PlanReport) Print() {
+	fmt.Printf("\n=== SCAN PLAN ===\n")
+	fmt.Printf("📁 Root: %s\n", report.Root)
+	fmt.Printf("📊 In scope: %d files, %s\n", report.TotalFiles, formatBytes(report.TotalBytes))
+
+	agents := make([]string, 0, len(report.Agents))
+	for agent := range report.Agents {
+		agents = append(agents, agent)
+	}
+	sort.Slice(agents, func(i, j int) bool {
+		a, b := report.Agents[agents[i]], report.Agents[agents[j]]
+		if a.Bytes != b.Bytes {
+			return a.Bytes > b.Bytes
+		}
+		return agents[i] < agents[j]
+	})
+	fmt.Printf("\n🤖 By agent:\n")
+	for _, agent := range agents {
+		count := report.Agents[agent]
+		fmt.Printf("   %-14s %8d files  %10s\n", agent, count.Files, formatBytes(count.Bytes))
+	}
+
+	fmt.Printf("\n📦 By size:\n")
+	for _, bucket := range report.SizeBuckets {
+		if bucket.Files == 0 {
+			continue
+		}
+		fmt.Printf("   %-14s %8d files  %10s  (probed %d, est. %v)\n", bucket.Label, bucket.Files,
+			formatBytes(bucket.Bytes), bucket.SampledFiles,
+			roundPlanDuration(time.Duration(bucket.EstimatedMs*float64(time.Millisecond))))
+	}
+
+	if len(report.Largest) > 0 {
+		fmt.Printf("\n🐘 Largest files:\n")
+		for _, f := range report.Largest {
+			fmt.Printf("   %10s  %s\n", formatBytes(f.Size), f.Path)
+		}
+	}
+
+	if report.Baseline != nil {
+		fmt.Printf("\n♻️  Baseline %s: %d of %d files (%s) unchanged and skippable\n",
+			report.Baseline.Manifest, report.Baseline.Unchanged, report.TotalFiles,
+			formatBytes(report.Baseline.UnchangedBytes))
+	}
+
+	fmt.Printf("\n⏳ Estimated full run: %s with %d workers\n", report.Estimate.Duration, report.Estimate.Workers)
+	fmt.Printf("   (%s)\n", strings.TrimSpace(report.Estimate.Assumption))
+}
+
+func writePlan(path string, report *PlanReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
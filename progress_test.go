@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProgressRatesThroughSlowdown(t *testing.T) {
+	// printProgress writes the progress line on every simulated second
+	silenceStdout(t)
+
+	const mb = 1 << 20
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	pt := newProgressTracker(start)
+	pt.SetExpectedBytes(1000 * mb)
+
+	// 60s at 10 files and 10 MiB per second
+	now := start
+	for i := 0; i < 60; i++ {
+		now = now.Add(time.Second)
+		pt.update(10, 0, 10*mb, now)
+	}
+	fast := pt.rates(now)
+	if fast.bytesPerSec != 10*mb || fast.filesPerSec != 10 {
+		t.Fatalf("fast phase rate = %.0f B/s, %.1f files/s; want 10 MiB/s, 10 files/s", fast.bytesPerSec, fast.filesPerSec)
+	}
+
+	// Then 60s at 1 file and 1 MiB per second. While the window still
+	// holds fast samples, the rate falls and the ETA rises every second.
+	prev := fast
+	for i := 1; i <= 60; i++ {
+		now = now.Add(time.Second)
+		pt.update(1, 0, mb, now)
+		r := pt.rates(now)
+
+		if r.bytesPerSec >= r.avgBytesPerSec {
+			t.Errorf("after %ds of slowdown windowed rate %.0f B/s is not below lifetime average %.0f B/s",
+				i, r.bytesPerSec, r.avgBytesPerSec)
+		}
+		if r.bytesPerSec > prev.bytesPerSec {
+			t.Errorf("after %ds of slowdown rate rose from %.0f to %.0f B/s", i, prev.bytesPerSec, r.bytesPerSec)
+		}
+		if i <= progressWindow && r.eta <= prev.eta {
+			t.Errorf("after %ds of slowdown ETA fell from %v to %v", i, prev.eta, r.eta)
+		}
+		prev = r
+	}
+
+	// Once the window holds only slow samples the rate settles
+	if prev.bytesPerSec != mb || prev.filesPerSec != 1 {
+		t.Errorf("settled rate = %.0f B/s, %.1f files/s; want 1 MiB/s, 1 file/s", prev.bytesPerSec, prev.filesPerSec)
+	}
+	if want := 340 * time.Second; prev.eta != want {
+		t.Errorf("settled ETA = %v, want %v", prev.eta, want)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// fileCompare orders manifest entries; anything that sorts FileInfo
+// sequences takes one so the key stays pluggable
+type fileCompare func(a, b *FileInfo) int
+
+var sortKeys = map[string]fileCompare{
+	"path": func(a, b *FileInfo) int { return strings.Compare(a.Path, b.Path) },
+	"size": func(a, b *FileInfo) int { return cmp.Compare(a.Size, b.Size) },
+	// Mtimes are all formatted as UTC RFC3339, which orders lexically
+	"mtime": func(a, b *FileInfo) int { return strings.Compare(a.Mtime, b.Mtime) },
+	"trust": func(a, b *FileInfo) int { return cmp.Compare(a.TrustScore, b.TrustScore) },
+}
+
+// sortSpec is the parsed -sort key[:asc|desc] flag
+type sortSpec struct {
+	key  string
+	desc bool
+}
+
+func (s *sortSpec) String() string {
+	if s.key == "" {
+		return "path:asc"
+	}
+	if s.desc {
+		return s.key + ":desc"
+	}
+	return s.key + ":asc"
+}
+
+func (s *sortSpec) Set(value string) error {
+	key, dir, _ := strings.Cut(strings.ToLower(value), ":")
+	if _, ok := sortKeys[key]; !ok {
+		return fmt.Errorf("unknown sort key %q (valid: path, size, mtime, trust)", key)
+	}
+
+	switch dir {
+	case "", "asc":
+		s.desc = false
+	case "desc":
+		s.desc = true
+	default:
+		return fmt.Errorf("unknown sort direction %q (valid: asc, desc)", dir)
+	}
+	s.key = key
+	return nil
+}
+
+// Key returns the selected sort key, defaulting to path
+func (s *sortSpec) Key() string {
+	if s.key == "" {
+		return "path"
+	}
+	return s.key
+}
+
+// Compare returns the ordering for the spec. Path ascending always breaks
+// ties, so equal keys still produce a deterministic manifest.
+func (s *sortSpec) Compare() fileCompare {
+	primary := sortKeys[s.Key()]
+	desc := s.desc
+	return func(a, b *FileInfo) int {
+		c := primary(a, b)
+		if desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+		return strings.Compare(a.Path, b.Path)
+	}
+}
+
+func sortFiles(files []FileInfo, compare fileCompare) {
+	sort.Slice(files, func(i, j int) bool { return compare(&files[i], &files[j]) < 0 })
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PhaseTiming is one instrumented phase of the run. Duration is the phase's
+// wall-clock span; Exclusive is the part of that span not already
+// attributed to an earlier-starting phase that was running at the same time.
+type PhaseTiming struct {
+	Phase        string   `json:"phase"`
+	Start        string   `json:"start"`
+	End          string   `json:"end"`
+	Duration     string   `json:"duration"`
+	DurationMs   float64  `json:"duration_ms"`
+	ExclusiveMs  float64  `json:"exclusive_ms"`
+	OverlapsWith []string `json:"overlaps_with,omitempty"`
+}
+
+// Timings is the per-phase breakdown recorded in run metadata. Phases that
+// finish after the manifest is built (encoding, compression) cannot appear
+// in the manifest they produce and are only reported on the console.
+type Timings struct {
+	Phases    []PhaseTiming `json:"phases"`
+	WallClock string        `json:"wall_clock"`
+}
+
+type phaseSpan struct {
+	name  string
+	start time.Time
+	end   time.Time
+}
+
+type phaseTimer struct {
+	mutex sync.Mutex
+	spans []phaseSpan
+}
+
+// Start begins timing a phase and returns the function that ends it
+func (pt *phaseTimer) Start(name string) func() {
+	pt.mutex.Lock()
+	idx := len(pt.spans)
+	pt.spans = append(pt.spans, phaseSpan{name: name, start: time.Now()})
+	pt.mutex.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			pt.mutex.Lock()
+			pt.spans[idx].end = time.Now()
+			pt.mutex.Unlock()
+		})
+	}
+}
+
+// completed returns the finished spans in start order
+func (pt *phaseTimer) completed() []phaseSpan {
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+
+	var spans []phaseSpan
+	for _, span := range pt.spans {
+		if !span.end.IsZero() {
+			spans = append(spans, span)
+		}
+	}
+	sort.SliceStable(spans, func(i, j int) bool { return spans[i].start.Before(spans[j].start) })
+	return spans
+}
+
+func overlap(a, b phaseSpan) time.Duration {
+	start, end := a.start, a.end
+	if b.start.After(start) {
+		start = b.start
+	}
+	if b.end.Before(end) {
+		end = b.end
+	}
+	if end.After(start) {
+		return end.Sub(start)
+	}
+	return 0
+}
+
+// coveredBy is how much of span lies inside the union of others, so time
+// shared with several of them is only counted once
+func coveredBy(span phaseSpan, others []phaseSpan) time.Duration {
+	var clipped []phaseSpan
+	for _, other := range others {
+		if overlap(span, other) == 0 {
+			continue
+		}
+		c := phaseSpan{start: other.start, end: other.end}
+		if c.start.Before(span.start) {
+			c.start = span.start
+		}
+		if c.end.After(span.end) {
+			c.end = span.end
+		}
+		clipped = append(clipped, c)
+	}
+	sort.Slice(clipped, func(i, j int) bool { return clipped[i].start.Before(clipped[j].start) })
+
+	var covered time.Duration
+	var reach time.Time
+	for _, c := range clipped {
+		if c.start.Before(reach) {
+			c.start = reach
+		}
+		if c.end.After(c.start) {
+			covered += c.end.Sub(c.start)
+			reach = c.end
+		}
+	}
+	return covered
+}
+
+// Timings snapshots the finished phases
+func (pt *phaseTimer) Timings() Timings {
+	spans := pt.completed()
+	timings := Timings{Phases: make([]PhaseTiming, 0, len(spans))}
+	if len(spans) == 0 {
+		return timings
+	}
+
+	first, last := spans[0].start, spans[0].end
+	for i, span := range spans {
+		duration := span.end.Sub(span.start)
+
+		var overlapsWith []string
+		for j, other := range spans {
+			if j != i && overlap(span, other) > 0 {
+				overlapsWith = append(overlapsWith, other.name)
+			}
+		}
+		// Time shared with an earlier phase stays with that phase
+		exclusive := duration - coveredBy(span, spans[:i])
+
+		if span.end.After(last) {
+			last = span.end
+		}
+		timings.Phases = append(timings.Phases, PhaseTiming{
+			Phase:        span.name,
+			Start:        span.start.UTC().Format(time.RFC3339Nano),
+			End:          span.end.UTC().Format(time.RFC3339Nano),
+			Duration:     duration.String(),
+			DurationMs:   float64(duration.Microseconds()) / 1000,
+			ExclusiveMs:  float64(exclusive.Microseconds()) / 1000,
+			OverlapsWith: overlapsWith,
+		})
+	}
+	timings.WallClock = last.Sub(first).String()
+	return timings
+}
+
+// Summary renders the finished phases as a single console line
+func (pt *phaseTimer) Summary() string {
+	timings := pt.Timings()
+	parts := make([]string, 0, len(timings.Phases))
+	for _, phase := range timings.Phases {
+		d := roundPhaseDuration(time.Duration(phase.DurationMs * float64(time.Millisecond)))
+		part := fmt.Sprintf("%s %v", phase.Phase, d)
+		if len(phase.OverlapsWith) > 0 {
+			excl := roundPhaseDuration(time.Duration(phase.ExclusiveMs * float64(time.Millisecond)))
+			part += fmt.Sprintf(" (%v exclusive, overlaps %s)", excl, strings.Join(phase.OverlapsWith, "/"))
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, " · ")
+}
+
+// Sub-millisecond phases would otherwise all print as 0s
+func roundPhaseDuration(d time.Duration) time.Duration {
+	if d < time.Millisecond {
+		return d.Round(time.Microsecond)
+	}
+	return d.Round(time.Millisecond)
+}
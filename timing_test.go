@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimingsExclusiveCountsSharedTimeOnce(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(s int) time.Time { return base.Add(time.Duration(s) * time.Second) }
+
+	// encoding [4,10) sits inside both discovery [0,8) and processing [2,9),
+	// so only [9,10) is its own
+	pt := &phaseTimer{spans: []phaseSpan{
+		{name: "discovery", start: at(0), end: at(8)},
+		{name: "processing", start: at(2), end: at(9)},
+		{name: "encoding", start: at(4), end: at(10)},
+	}}
+
+	want := map[string]float64{
+		"discovery":  8000,
+		"processing": 1000,
+		"encoding":   1000,
+	}
+	for _, phase := range pt.Timings().Phases {
+		if phase.ExclusiveMs != want[phase.Phase] {
+			t.Errorf("%s exclusive = %vms, want %vms", phase.Phase, phase.ExclusiveMs, want[phase.Phase])
+		}
+	}
+}
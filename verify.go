@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// verifyReport tallies a -verify run against a filesystem tree
+type verifyReport struct {
+	checked    int64
+	matched    int64
+	mismatched int64
+	missing    int64
+	skipped    int64
+	failed     int64
+}
+
+// OK reports whether every checked entry still hashes to its recorded digest
+func (vr *verifyReport) OK() bool {
+	return vr.mismatched == 0 && vr.missing == 0 && vr.failed == 0
+}
+
+// verifyManifest rehashes every file entry of the manifest under root using
+// the scheme the entry declares. Entries without a real digest and
+// non-regular entries (symlinks, submodules) are skipped.
+func verifyManifest(root, manifestPath string, workers int, verbose bool) (*verifyReport, error) {
+	manifest, err := readManifest(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if workers < 1 {
+		workers = 1
+	}
+	// Chunk sizes come from each entry; the threshold is unused here
+	hasher := newChunkHasher(0, 0, workers)
+	report := &verifyReport{}
+	jobs := make(chan *FileInfo, workers*2)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for entry := range jobs {
+				verifyEntry(root, entry, hasher, report, verbose)
+			}
+		}()
+	}
+
+	for i := range manifest.Files {
+		entry := &manifest.Files[i]
+		if entry.Type != "" || entry.SHA256 == "" || entry.SHA256 == "dry-run-hash" {
+			report.skipped++
+			continue
+		}
+		jobs <- entry
+	}
+	close(jobs)
+	wg.Wait()
+	return report, nil
+}
+
+func verifyEntry(root string, entry *FileInfo, hasher *chunkHasher, report *verifyReport, verbose bool) {
+	atomic.AddInt64(&report.checked, 1)
+
+	// A hostile manifest must not make us read outside root
+	path := filepath.FromSlash(entry.Path)
+	if !filepath.IsLocal(path) {
+		atomic.AddInt64(&report.failed, 1)
+		fmt.Printf("❌ Failed: %s - path escapes %s\n", entry.Path, root)
+		return
+	}
+
+	chunkSize, err := parseHashScheme(entry.HashScheme)
+	if err != nil {
+		atomic.AddInt64(&report.failed, 1)
+		fmt.Printf("❌ Failed: %s - %v\n", entry.Path, err)
+		return
+	}
+
+	hash, err := hasher.HashScheme(filepath.Join(root, path), chunkSize, nil)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		atomic.AddInt64(&report.missing, 1)
+		fmt.Printf("⚠️  Missing: %s\n", entry.Path)
+	case err != nil:
+		atomic.AddInt64(&report.failed, 1)
+		fmt.Printf("❌ Failed: %s - %v\n", entry.Path, err)
+	case hash != entry.SHA256:
+		atomic.AddInt64(&report.mismatched, 1)
+		fmt.Printf("❌ Mismatch: %s (%s)\n", entry.Path, displayScheme(entry.HashScheme))
+	default:
+		atomic.AddInt64(&report.matched, 1)
+		if verbose {
+			fmt.Printf("✅ Verified: %s (%s)\n", entry.Path, displayScheme(entry.HashScheme))
+		}
+	}
+}
+
+func displayScheme(scheme string) string {
+	if scheme == "" {
+		return hashSchemeSHA256
+	}
+	return scheme
+}
+
+func (vr *verifyReport) Print() {
+	fmt.Printf("\n=== VERIFY RESULTS ===\n")
+	fmt.Printf("🔎 Checked: %d files\n", vr.checked)
+	fmt.Printf("✅ Matched: %d files\n", vr.matched)
+	fmt.Printf("❌ Mismatched: %d files\n", vr.mismatched)
+	fmt.Printf("⚠️  Missing: %d files\n", vr.missing)
+	if vr.failed > 0 {
+		fmt.Printf("💥 Unreadable: %d files\n", vr.failed)
+	}
+	if vr.skipped > 0 {
+		fmt.Printf("⏭️  Skipped: %d entries without a verifiable digest\n", vr.skipped)
+	}
+}